@@ -0,0 +1,345 @@
+package tsnsrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+var whoContextKey = contextKey{"who"}
+var grantsContextKey = contextKey{"grants"}
+
+var accessDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_access_denied",
+	Help: "Number of requests denied by -allow, -deny and -appCapability rules",
+}, []string{"service"})
+
+type principalKind int
+
+const (
+	principalUser principalKind = iota
+	principalDomain
+	principalTag
+	principalNode
+	principalRole
+	principalFunnel
+)
+
+var principalKindNames = map[principalKind]string{
+	principalUser:   "user",
+	principalDomain: "domain",
+	principalTag:    "tag",
+	principalNode:   "node",
+	principalRole:   "role",
+	principalFunnel: "funnel",
+}
+
+// principal matches the identities of requesting users or nodes.
+type principal struct {
+	kind  principalKind
+	value string
+}
+
+func (p principal) String() string {
+	return principalKindNames[p.kind] + ":" + p.value
+}
+
+// matches returns whether the requestor's identity, or the roles
+// that the service's -appCapability grants them, match p.
+func (p principal) matches(who *apitype.WhoIsResponse, roles []string) bool {
+	if who == nil {
+		return false
+	}
+	switch p.kind {
+	case principalRole:
+		return slices.Contains(roles, p.value)
+	case principalUser:
+		return isTailnetUser(who) && strings.EqualFold(who.UserProfile.LoginName, p.value)
+	case principalDomain:
+		if !isTailnetUser(who) {
+			return false
+		}
+		_, domain, ok := strings.Cut(who.UserProfile.LoginName, "@")
+		return ok && strings.EqualFold(domain, p.value)
+	case principalTag:
+		return who.Node != nil && slices.Contains(who.Node.Tags, "tag:"+p.value)
+	case principalNode:
+		return who.Node != nil && (strings.EqualFold(who.Node.ComputedName, p.value) ||
+			strings.EqualFold(strings.TrimSuffix(who.Node.Name, "."), p.value))
+	case principalFunnel:
+		return who.Node == nil && who.UserProfile != nil && strings.EqualFold(who.UserProfile.LoginName, funnelLoginPrefix+p.value)
+	}
+	return false
+}
+
+// isTailnetUser returns whether who is a user on the tailnet, as
+// opposed to one that authenticated on the funnel (who has no node).
+func isTailnetUser(who *apitype.WhoIsResponse) bool {
+	return who.Node != nil && who.UserProfile != nil
+}
+
+// accessRule lists the identities that an -allow or -deny flag
+// applies to, optionally only for requests under a path prefix.
+type accessRule struct {
+	path       string
+	principals []principal
+}
+
+func (rule *accessRule) String() string {
+	var serialized []string
+	for _, p := range rule.principals {
+		serialized = append(serialized, p.String())
+	}
+	s := strings.Join(serialized, ",")
+	if rule.path != "" {
+		s = rule.path + "=" + s
+	}
+	return s
+}
+
+// appliesTo returns whether the rule covers requests for path.
+func (rule *accessRule) appliesTo(path string) bool {
+	return pathHasPrefix(path, rule.path)
+}
+
+// pathHasPrefix returns whether path is prefix, or lies below it: A
+// prefix of "/admin" covers "/admin" and "/admin/users", but not
+// "/administrator".
+func pathHasPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// matches returns whether any of the rule's principals match who.
+func (rule *accessRule) matches(who *apitype.WhoIsResponse, roles []string) bool {
+	return slices.ContainsFunc(rule.principals, func(p principal) bool { return p.matches(who, roles) })
+}
+
+type accessRules []accessRule
+
+func (rules *accessRules) String() string {
+	var serialized []string
+	for _, rule := range *rules {
+		serialized = append(serialized, rule.String())
+	}
+	return strings.Join(serialized, " ")
+}
+
+var errAccessRuleFormat = errors.New("access rules must look like '[/path=]user:<login>|domain:<domain>|tag:<tag>|node:<name>|role:<role>|funnel:<login>[,...]'")
+
+func (rules *accessRules) Set(value string) error {
+	var rule accessRule
+	list := value
+	if strings.HasPrefix(value, "/") {
+		var ok bool
+		rule.path, list, ok = strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("%w: missing identities in %#v", errAccessRuleFormat, value)
+		}
+	}
+	for item := range strings.SplitSeq(list, ",") {
+		kindName, name, _ := strings.Cut(strings.TrimSpace(item), ":")
+		kind, ok := principalKindByName(kindName)
+		if !ok || name == "" {
+			return fmt.Errorf("%w: %#v", errAccessRuleFormat, item)
+		}
+		rule.principals = append(rule.principals, principal{kind, name})
+	}
+	*rules = append(*rules, rule)
+	return nil
+}
+
+func principalKindByName(name string) (principalKind, bool) {
+	for kind, kindName := range principalKindNames {
+		if kindName == name {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+func (s *TailnetSrv) hasAccessRules() bool {
+	return len(s.Allow) > 0 || len(s.Deny) > 0 || s.AppCapability != ""
+}
+
+// needsIdentity returns whether anything besides the identity headers
+// (which -suppressWhois turns off) needs to know who made requests.
+func (s *TailnetSrv) needsIdentity() bool {
+	return s.hasAccessRules() || s.hasRateLimits() || s.AuthURL != "" || s.signsTokens()
+}
+
+// appGrant is one of the values that the tailnet policy file grants
+// for the service's -appCapability. Grants only cover requests for
+// their paths (prefixes) with their methods; if they list none, they
+// cover all of them.
+type appGrant struct {
+	Paths   []string `json:"paths,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+	Roles   []string `json:"roles,omitempty"`
+
+	raw tailcfg.RawMessage
+}
+
+// covers returns whether g allows the request method on path.
+func (g *appGrant) covers(method, path string) bool {
+	if len(g.Paths) > 0 && !slices.ContainsFunc(g.Paths, func(p string) bool { return pathHasPrefix(path, p) }) {
+		return false
+	}
+	return len(g.Methods) == 0 || slices.ContainsFunc(g.Methods, func(m string) bool { return strings.EqualFold(m, method) })
+}
+
+// appGrants returns the requestor's grants for the service's
+// -appCapability that cover r.
+func (s *ValidTailnetSrv) appGrants(who *apitype.WhoIsResponse, r *http.Request) []appGrant {
+	var grants []appGrant
+	for _, grant := range s.parseGrants(who) {
+		if grant.covers(r.Method, r.URL.Path) {
+			grants = append(grants, grant)
+		}
+	}
+	return grants
+}
+
+// parseGrants returns all of the requestor's grants for the
+// service's -appCapability.
+func (s *ValidTailnetSrv) parseGrants(who *apitype.WhoIsResponse) []appGrant {
+	if s.AppCapability == "" || who == nil {
+		return nil
+	}
+	var grants []appGrant
+	for _, raw := range who.CapMap[tailcfg.PeerCapability(s.AppCapability)] {
+		grant := appGrant{raw: raw}
+		if err := json.Unmarshal([]byte(raw), &grant); err != nil {
+			s.log().Warn("Ignoring invalid app capability grant",
+				"capability", s.AppCapability,
+				"grant", raw,
+				"error", err,
+			)
+			continue
+		}
+		grants = append(grants, grant)
+	}
+	return grants
+}
+
+// grantsJSON returns the raw values of grants as a JSON array.
+func grantsJSON(grants []appGrant) (string, error) {
+	values := make([]json.RawMessage, 0, len(grants))
+	for _, grant := range grants {
+		values = append(values, json.RawMessage(grant.raw))
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("encoding app capability grants: %w", err)
+	}
+	return string(encoded), nil
+}
+
+var errAccessDenied = errors.New("access denied")
+
+// checkAccess returns an error if the -allow and -deny rules don't
+// let who request path, given the grants that cover the request. Any
+// matching -deny rule denies access; for each path prefix that has
+// -allow rules, one of them must match; and with an -appCapability,
+// there must be a grant.
+func (s *ValidTailnetSrv) checkAccess(who *apitype.WhoIsResponse, grants []appGrant, path string) error {
+	var roles []string
+	for _, grant := range grants {
+		roles = append(roles, grant.Roles...)
+	}
+	for _, rule := range s.Deny {
+		if rule.appliesTo(path) && rule.matches(who, roles) {
+			return fmt.Errorf("%w by -deny %v", errAccessDenied, rule.String())
+		}
+	}
+	if s.AppCapability != "" && len(grants) == 0 {
+		return fmt.Errorf("%w: no %v grant covers the request", errAccessDenied, s.AppCapability)
+	}
+	allowed := map[string]bool{}
+	for _, rule := range s.Allow {
+		if rule.appliesTo(path) {
+			allowed[rule.path] = allowed[rule.path] || rule.matches(who, roles)
+		}
+	}
+	for path, ok := range allowed {
+		switch {
+		case ok:
+		case path == "":
+			return fmt.Errorf("%w: no -allow rule matches", errAccessDenied)
+		default:
+			return fmt.Errorf("%w: no -allow rule for %#v matches", errAccessDenied, path)
+		}
+	}
+	return nil
+}
+
+var errIdentityUnknown = errors.New("could not look up requestor identity")
+
+// identify looks up who is making each request, and stores the
+// result (or nil, if it's unknown) in the request's context. If the
+// service has access rules, tailnet requests whose requestor can't be
+// looked up get a 503 status, since a -deny rule might have matched
+// them.
+func (s *ValidTailnetSrv) identify(forFunnel bool, next http.Handler) http.Handler {
+	if s.whois == nil || s.SuppressWhois && !s.needsIdentity() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if s.WhoisTimeout > 0 {
+			var cancel func()
+			ctx, cancel = context.WithTimeout(ctx, s.WhoisTimeout)
+			defer cancel()
+		}
+		who, err := s.whois(ctx, r.RemoteAddr)
+		if err != nil {
+			s.log().Warn("could not look up requestor identity",
+				"error", err,
+				"request", r,
+			)
+			if s.hasAccessRules() && !forFunnel {
+				accessDenied.With(prometheus.Labels{"service": s.Name}).Inc()
+				http.Error(w, "503 Service Unavailable: "+errIdentityUnknown.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			who = nil
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), whoContextKey, who)))
+	})
+}
+
+// authorize answers requests that the -allow, -deny and
+// -appCapability rules don't let through with a 403 status, and
+// stores the grants covering the others in their context.
+func (s *ValidTailnetSrv) authorize(next http.Handler) http.Handler {
+	if !s.hasAccessRules() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, _ := r.Context().Value(whoContextKey).(*apitype.WhoIsResponse)
+		grants := s.appGrants(who, r)
+		if err := s.checkAccess(who, grants, r.URL.Path); err != nil {
+			login := ""
+			if who != nil && who.UserProfile != nil {
+				login = who.UserProfile.LoginName
+			}
+			s.log().Warn("Denied request",
+				"url", r.URL,
+				"origin_login", login,
+				"reason", err,
+			)
+			accessDenied.With(prometheus.Labels{"service": s.Name}).Inc()
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), grantsContextKey, grants)))
+	})
+}
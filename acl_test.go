@@ -0,0 +1,204 @@
+package tsnsrv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func whoIs(login, node string, tags ...string) *apitype.WhoIsResponse {
+	return &apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: login},
+		Node:        &tailcfg.Node{Name: node + ".tailnet-1234.ts.net.", ComputedName: node, Tags: tags},
+	}
+}
+
+func TestAccessRuleFormat(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		value string
+		ok    bool
+	}{
+		{"user:alice@example.com", true},
+		{"domain:example.com,tag:ci", true},
+		{"/admin=user:alice@example.com,node:laptop", true},
+		{"funnel:carol@example.com", true},
+
+		// Expected to fail:
+		{"alice@example.com", false},
+		{"group:admins", false},
+		{"tag:", false},
+		{"/admin", false},
+	} {
+		test := elt
+		t.Run(test.value, func(t *testing.T) {
+			t.Parallel()
+			var rules accessRules
+			err := rules.Set(test.value)
+			if !test.ok {
+				assert.ErrorIs(t, err, errAccessRuleFormat)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.value, rules.String())
+		})
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	t.Parallel()
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "TestCheckAccess",
+		"-allow", "domain:example.com,tag:ci",
+		"-allow", "/admin=user:alice@example.com",
+		"-allow", "funnel:carol@example.com",
+		"-deny", "node:lost-laptop",
+		"-deny", "/private=tag:ci",
+		"http://example.com",
+	})
+	require.NoError(t, err)
+
+	alice := whoIs("alice@example.com", "laptop")
+	bob := whoIs("bob@example.com", "desktop")
+	ci := whoIs("tagged-devices", "runner", "tag:ci")
+	mallory := whoIs("mallory@example.org", "laptop")
+	lost := whoIs("alice@example.com", "lost-laptop")
+	funnelAlice := funnelUser("alice@example.com", "")
+	funnelCarol := funnelUser("carol@example.com", "")
+	assert.False(t, principal{principalFunnel, "carol@example.com"}.matches(whoIs("carol@example.com", "laptop"), nil),
+		"funnel: rules don't match tailnet users")
+
+	for _, elt := range []struct {
+		name    string
+		who     *apitype.WhoIsResponse
+		path    string
+		allowed bool
+	}{
+		{"user in the domain", bob, "/", true},
+		{"tagged node", ci, "/builds", true},
+		{"user outside the domain", mallory, "/", false},
+		{"unknown identity", nil, "/", false},
+		{"alice on /admin", alice, "/admin/users", true},
+		{"bob on /admin", bob, "/admin/users", false},
+		{"bob on /admin itself", bob, "/admin", false},
+		{"bob next to /admin", bob, "/administrator", true},
+		{"tagged node on /private", ci, "/private/builds", false},
+		{"tagged node next to /private", ci, "/private-builds", true},
+		{"denied node", lost, "/", false},
+		{"funnel user", funnelCarol, "/", true},
+		{"funnel user with a tailnet login", funnelAlice, "/", false},
+		{"funnel user with a tailnet login on /admin", funnelAlice, "/admin/users", false},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			err := s.checkAccess(test.who, nil, test.path)
+			if test.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, errAccessDenied)
+			}
+		})
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Tailscale-User-LoginName")))
+	}))
+	t.Cleanup(upstream.Close)
+
+	for _, elt := range []struct {
+		name   string
+		who    *apitype.WhoIsResponse
+		status int
+	}{
+		{"allowed", whoIs("alice@example.com", "laptop"), http.StatusOK},
+		{"denied", whoIs("mallory@example.org", "laptop"), http.StatusForbidden},
+		{"lookup failed", nil, http.StatusServiceUnavailable},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "TestAccessControl", "-allow", "domain:example.com", "-deny", "user:mallory@example.com", upstream.URL})
+			require.NoError(t, err)
+			s.whois = func(context.Context, string) (*apitype.WhoIsResponse, error) {
+				if test.who == nil {
+					return nil, context.DeadlineExceeded
+				}
+				return test.who, nil
+			}
+			proxy := httptest.NewServer(s.mux(http.DefaultTransport, false))
+			defer proxy.Close()
+
+			status, body := getBody(t, proxy.Client(), proxy.URL)
+			assert.Equal(t, test.status, status)
+			if test.status == http.StatusOK {
+				assert.Equal(t, test.who.UserProfile.LoginName, body)
+			}
+		})
+	}
+}
+
+func TestAppCapability(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Tailscale-App-Capability")))
+	}))
+	t.Cleanup(upstream.Close)
+
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "TestAppCapability",
+		"-appCapability", "example.com/cap/tsnsrv",
+		"-allow", "/admin=role:admin",
+		upstream.URL,
+	})
+	require.NoError(t, err)
+	who := whoIs("alice@example.com", "laptop")
+	who.CapMap = tailcfg.PeerCapMap{
+		"example.com/cap/tsnsrv": {
+			`{"paths": ["/docs"], "methods": ["GET"]}`,
+			`{"paths": ["/admin"], "roles": ["admin"]}`,
+			`not json`,
+		},
+		"example.com/cap/other": {`{"roles": ["admin"]}`},
+	}
+	s.whois = func(context.Context, string) (*apitype.WhoIsResponse, error) { return who, nil }
+	proxy := httptest.NewServer(s.mux(http.DefaultTransport, false))
+	t.Cleanup(proxy.Close)
+
+	status, body := getBody(t, proxy.Client(), proxy.URL+"/docs/index.html")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[{"paths": ["/docs"], "methods": ["GET"]}]`, body)
+
+	status, body = getBody(t, proxy.Client(), proxy.URL+"/admin/users")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[{"paths": ["/admin"], "roles": ["admin"]}]`, body)
+
+	resp, err := proxy.Client().Post(proxy.URL+"/docs/index.html", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "no grant covers POST requests to /docs")
+
+	status, _ = getBody(t, proxy.Client(), proxy.URL+"/")
+	assert.Equal(t, http.StatusForbidden, status, "no grant covers /")
+	status, _ = getBody(t, proxy.Client(), proxy.URL+"/docs-internal")
+	assert.Equal(t, http.StatusForbidden, status, "no grant covers paths next to /docs")
+
+	// Grants without the role don't get in where the role is required:
+	who.CapMap["example.com/cap/tsnsrv"] = []tailcfg.RawMessage{`{"paths": ["/"]}`}
+	status, _ = getBody(t, proxy.Client(), proxy.URL+"/admin/users")
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestAccessRulesNeedClient(t *testing.T) {
+	t.Parallel()
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-deny", "tag:untrusted", "http://example.com"})
+	require.NoError(t, err)
+	require.ErrorIs(t, s.activate(), errAccessRulesNeedClient)
+}
@@ -0,0 +1,278 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var certificateExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tsnsrv_certificate_expiry_timestamp_seconds",
+	Help: "Unix time at which a custom certificate (from -certificateFile or -sniCertificate) that a service serves expires",
+}, []string{"service", "file"})
+
+var errBothUpstreamCertificateFileKeyFile = errors.New("when providing either an upstream certificate or key file, the other must be provided")
+var errNoCACertificates = errors.New("no certificates found in CA file")
+
+// upstreamTLSFiles holds the certificates that the service's
+// -upstreamCertificateFile, -upstreamKeyFile and -upstreamCAFile
+// settings load.
+type upstreamTLSFiles struct {
+	cert    *tls.Certificate
+	rootCAs *x509.CertPool
+}
+
+// loadUpstreamTLS loads the client certificate and CA bundle for
+// connections to upstream services, if they aren't loaded yet.
+func (s *ValidTailnetSrv) loadUpstreamTLS() error {
+	if s.upstreamTLS != nil {
+		return nil
+	}
+	var files upstreamTLSFiles
+	if s.UpstreamCertificateFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.UpstreamCertificateFile, s.UpstreamKeyFile)
+		if err != nil {
+			return fmt.Errorf("loading upstream client certificate: %w", err)
+		}
+		files.cert = &cert
+	}
+	if s.UpstreamCAFile != "" {
+		pem, err := os.ReadFile(s.UpstreamCAFile)
+		if err != nil {
+			return fmt.Errorf("loading upstream CA file: %w", err)
+		}
+		files.rootCAs = x509.NewCertPool()
+		if !files.rootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: %v", errNoCACertificates, s.UpstreamCAFile)
+		}
+	}
+	s.upstreamTLS = &files
+	return nil
+}
+
+// upstreamTLSConfig returns the TLS config for connections to
+// upstream services.
+func (s *ValidTailnetSrv) upstreamTLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: s.UpstreamServerName,
+	}
+	if s.upstreamTLS != nil {
+		config.RootCAs = s.upstreamTLS.rootCAs
+		if s.upstreamTLS.cert != nil {
+			config.Certificates = []tls.Certificate{*s.upstreamTLS.cert}
+		}
+	}
+	if s.InsecureHTTPS {
+		config.InsecureSkipVerify = true // #nosec This is explicitly requested by the user
+	}
+	if s.UpstreamAllowInsecureCiphers {
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			config.CipherSuites = append(config.CipherSuites, suite.ID)
+		}
+	}
+	return config
+}
+
+// certPollInterval is how often custom certificate files are checked
+// for changes.
+var certPollInterval = 10 * time.Second
+
+// certReloader serves the certificate from a pair of certificate and
+// key files, and picks up a new one when the files change (e.g. when
+// the certificate gets renewed).
+type certReloader struct {
+	s                 *ValidTailnetSrv
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+	lastCert, lastKey []byte
+}
+
+// loadCertificate loads the certificate from certFile and keyFile.
+func (s *ValidTailnetSrv) loadCertificate(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{s: s, certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate files again, if they changed since
+// they were last loaded. If they don't hold a valid key pair (e.g.
+// because only one of them was replaced so far), it keeps serving the
+// previous certificate.
+func (r *certReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(r.certFile)
+	if err != nil {
+		return false, fmt.Errorf("reading certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("reading certificate key: %w", err)
+	}
+	if bytes.Equal(certPEM, r.lastCert) && bytes.Equal(keyPEM, r.lastKey) {
+		return false, nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("loading certificate %v: %w", r.certFile, err)
+	}
+	r.cert.Store(&cert)
+	r.lastCert, r.lastKey = certPEM, keyPEM
+	certificateExpiry.With(prometheus.Labels{"service": r.s.Name, "file": r.certFile}).Set(float64(cert.Leaf.NotAfter.Unix()))
+	return true, nil
+}
+
+// getCertificate returns the most recently loaded certificate, for
+// tls.Config.GetCertificate.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// watch reloads the certificate whenever its files change, until ctx
+// is done.
+func (r *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := r.reload()
+		if err != nil {
+			r.s.log().Warn("Could not reload certificate, keeping the previous one", "path", r.certFile, "error", err)
+			continue
+		}
+		if reloaded {
+			r.s.log().Info("Reloaded certificate", "path", r.certFile, "expires", r.cert.Load().Leaf.NotAfter)
+		}
+	}
+}
+
+// sniCertificate is a certificate that TLS listeners serve to clients
+// that ask for a server name (or, with a leading "*.", for any name
+// directly below a domain).
+type sniCertificate struct {
+	serverName        string
+	certFile, keyFile string
+}
+
+type sniCertificates []sniCertificate
+
+func (cs *sniCertificates) String() string {
+	serialized := make([]string, 0, len(*cs))
+	for _, c := range *cs {
+		serialized = append(serialized, c.serverName+"="+c.certFile+","+c.keyFile)
+	}
+	return strings.Join(serialized, ", ")
+}
+
+var errSNICertificateFormat = errors.New("SNI certificates must look like '[*.]<server name>=<certificate file>,<key file>'")
+
+func (cs *sniCertificates) Set(value string) error {
+	serverName, files, ok := strings.Cut(value, "=")
+	certFile, keyFile, hasKey := strings.Cut(files, ",")
+	if !ok || !hasKey || certFile == "" || keyFile == "" || !validServerNamePattern(serverName) {
+		return fmt.Errorf("%w: %#v", errSNICertificateFormat, value)
+	}
+	*cs = append(*cs, sniCertificate{serverName, certFile, keyFile})
+	return nil
+}
+
+var errClientCertificateNeedsCA = errors.New("-requireClientCertificate needs a -clientCAFile")
+var errNoCertificate = errors.New("no certificate for this server name")
+
+// listenerCerts are the certificates that a service's TLS listeners
+// serve in place of (or alongside) the node's tailscale certificate,
+// and the CAs that they verify client certificates with.
+type listenerCerts struct {
+	custom    *certReloader   // from -certificateFile, if given
+	sni       []*certReloader // one for each of the SNICertificates
+	clientCAs *x509.CertPool  // from -clientCAFile, if given
+}
+
+// loadListenerCerts loads the service's custom certificates and client
+// CAs, and keeps reloading the certificates until ctx is done.
+func (s *ValidTailnetSrv) loadListenerCerts(ctx context.Context) error {
+	var certs listenerCerts
+	var reloaders []*certReloader
+	if s.certificateFile != "" {
+		custom, err := s.loadCertificate(s.certificateFile, s.keyFile)
+		if err != nil {
+			return fmt.Errorf("custom certificate: %w", err)
+		}
+		certs.custom = custom
+		reloaders = append(reloaders, custom)
+	}
+	for _, c := range s.SNICertificates {
+		reloader, err := s.loadCertificate(c.certFile, c.keyFile)
+		if err != nil {
+			return fmt.Errorf("certificate for %v: %w", c.serverName, err)
+		}
+		certs.sni = append(certs.sni, reloader)
+		reloaders = append(reloaders, reloader)
+	}
+	if s.ClientCAFile != "" {
+		pem, err := os.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading client CA file: %w", err)
+		}
+		certs.clientCAs = x509.NewCertPool()
+		if !certs.clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: %v", errNoCACertificates, s.ClientCAFile)
+		}
+	}
+	for _, reloader := range reloaders {
+		go reloader.watch(ctx)
+	}
+	s.certs = &certs
+	return nil
+}
+
+// getCertificate returns the certificate for the server name that a
+// client asks for: the first matching -sniCertificate, or else the
+// custom certificate, or else the node's tailscale certificate.
+func (s *ValidTailnetSrv) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for i, c := range s.SNICertificates {
+		if serverNameMatches(c.serverName, hello.ServerName) {
+			return s.certs.sni[i].getCertificate(hello)
+		}
+	}
+	if s.certs.custom != nil {
+		return s.certs.custom.getCertificate(hello)
+	}
+	if s.client == nil {
+		return nil, fmt.Errorf("%w: %#v", errNoCertificate, hello.ServerName)
+	}
+	return s.client.GetCertificate(hello) //nolint:wrapcheck // the TLS server reports it
+}
+
+// listenerTLSConfig returns the TLS config for the service's TLS
+// listeners on the tailnet.
+func (s *ValidTailnetSrv) listenerTLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if s.certs.clientCAs != nil {
+		config.ClientCAs = s.certs.clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.RequireClientCertificate {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config
+}
@@ -0,0 +1,319 @@
+package tsnsrv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	file string // the CA certificate, PEM-encoded
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tsnsrv test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	ca := &testCA{t: t, cert: cert, key: key, pool: x509.NewCertPool()}
+	ca.pool.AddCert(cert)
+	ca.file = writePEM(t, "ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+// issue returns a certificate for name, valid until notAfter, and the
+// files holding it and its key.
+func (ca *testCA) issue(name string, notAfter time.Time) (tls.Certificate, string, string) {
+	t := ca.t
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile := writePEM(t, name+".pem", "CERTIFICATE", der)
+	keyFile := writePEM(t, name+"-key.pem", "EC PRIVATE KEY", keyDER)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	return cert, certFile, keyFile
+}
+
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	t.Parallel()
+	ca := newTestCA(t)
+	serverCert, _, _ := ca.issue("app.internal", time.Now().Add(time.Hour))
+	_, clientCertFile, clientKeyFile := ca.issue("tsnsrv.internal", time.Now().Add(time.Hour))
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	upstream.TLS = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+
+	mTLS := []string{
+		"-upstreamCAFile", ca.file,
+		"-upstreamServerName", "app.internal",
+		"-upstreamCertificateFile", clientCertFile,
+		"-upstreamKeyFile", clientKeyFile,
+	}
+	for _, elt := range []struct {
+		name   string
+		args   []string
+		status int
+	}{
+		{"mutual TLS", mTLS, http.StatusOK},
+		{"no client certificate", mTLS[:4], http.StatusBadGateway},
+		{"no CA", mTLS[2:], http.StatusBadGateway},
+		{"no server name", append(mTLS[:2:2], mTLS[4:]...), http.StatusBadGateway},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			args := append([]string{"tsnsrv", "-name", t.Name(), "-suppressTailnetDialer"}, test.args...)
+			s, _, err := TailnetSrvFromArgs(append(args, upstream.URL))
+			require.NoError(t, err)
+			require.NoError(t, s.loadUpstreamTLS())
+			transport := s.newTransport()
+			t.Cleanup(transport.Close)
+			proxy := httptest.NewServer(s.mux(transport, false))
+			t.Cleanup(proxy.Close)
+
+			status, body := getBody(t, proxy.Client(), proxy.URL)
+			assert.Equal(t, test.status, status)
+			if test.status == http.StatusOK {
+				assert.Equal(t, "tsnsrv.internal", body)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSFiles(t *testing.T) {
+	t.Parallel()
+	_, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-upstreamCertificateFile", "client.pem", "https://example.com"})
+	require.ErrorIs(t, err, errBothUpstreamCertificateFileKeyFile)
+
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-upstreamCAFile", writePEM(t, "empty.pem", "NOTHING", nil), "https://example.com"})
+	require.NoError(t, err)
+	require.ErrorIs(t, s.loadUpstreamTLS(), errNoCACertificates)
+}
+
+func TestCertificateReload(t *testing.T) {
+	t.Parallel()
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "key.pem")
+	install := func(notAfter time.Time) tls.Certificate {
+		cert, issuedCert, issuedKey := ca.issue("app.example.com", notAfter)
+		for from, to := range map[string]string{issuedCert: certFile, issuedKey: keyFile} {
+			contents, err := os.ReadFile(from)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(to, contents, 0o600))
+		}
+		return cert
+	}
+	first := install(time.Now().Add(time.Hour))
+
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-certificateFile", certFile, "-keyFile", keyFile, "http://example.com"})
+	require.NoError(t, err)
+	certs, err := s.loadCertificate(certFile, keyFile)
+	require.NoError(t, err)
+	served, err := certs.getCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.Certificate, served.Certificate)
+	expiry := certificateExpiry.With(prometheus.Labels{"service": t.Name(), "file": certFile})
+	assert.InDelta(t, float64(first.Leaf.NotAfter.Unix()), testutil.ToFloat64(expiry), 0)
+
+	reloaded, err := certs.reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded, "unchanged files don't get reloaded")
+
+	second := install(time.Now().Add(48 * time.Hour))
+	reloaded, err = certs.reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	served, err = certs.getCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.Certificate, served.Certificate)
+	assert.InDelta(t, float64(second.Leaf.NotAfter.Unix()), testutil.ToFloat64(expiry), 0)
+
+	require.NoError(t, os.WriteFile(keyFile, []byte("half-written"), 0o600))
+	_, err = certs.reload()
+	require.Error(t, err)
+	served, err = certs.getCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.Certificate, served.Certificate, "broken files keep the previous certificate")
+}
+
+func TestSNICertificateFormat(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		value string
+		valid bool
+	}{
+		{"app.internal=cert.pem,key.pem", true},
+		{"*.lab.internal=cert.pem,key.pem", true},
+		{"app.internal=cert.pem", false},
+		{"app.internal=,key.pem", false},
+		{"=cert.pem,key.pem", false},
+		{"*.=cert.pem,key.pem", false},
+		{"a.*.internal=cert.pem,key.pem", false},
+	} {
+		test := elt
+		t.Run(test.value, func(t *testing.T) {
+			t.Parallel()
+			var certs sniCertificates
+			err := certs.Set(test.value)
+			if test.valid {
+				require.NoError(t, err)
+				assert.Equal(t, test.value, certs.String())
+			} else {
+				require.ErrorIs(t, err, errSNICertificateFormat)
+			}
+		})
+	}
+
+	_, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-requireClientCertificate", "http://example.com"})
+	require.ErrorIs(t, err, errClientCertificateNeedsCA)
+}
+
+func TestListenerCertificates(t *testing.T) {
+	t.Parallel()
+	ca := newTestCA(t)
+	_, customCert, customKey := ca.issue("tsnsrv.example.com", time.Now().Add(time.Hour))
+	_, appCert, appKey := ca.issue("app.internal", time.Now().Add(time.Hour))
+	_, labCert, labKey := ca.issue("*.lab.internal", time.Now().Add(time.Hour))
+	clientCert, _, _ := ca.issue("client.internal", time.Now().Add(time.Hour))
+	strangerCert, _, _ := newTestCA(t).issue("stranger.internal", time.Now().Add(time.Hour))
+
+	serve := func(t *testing.T, extra ...string) string {
+		t.Helper()
+		args := append([]string{"tsnsrv", "-name", t.Name(),
+			"-certificateFile", customCert, "-keyFile", customKey,
+			"-sniCertificate", "app.internal=" + appCert + "," + appKey,
+			"-sniCertificate", "*.lab.internal=" + labCert + "," + labKey,
+			"-clientCAFile", ca.file,
+		}, extra...)
+		s, _, err := TailnetSrvFromArgs(append(args, "http://example.com"))
+		require.NoError(t, err)
+		require.NoError(t, s.loadListenerCerts(t.Context()))
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		server := &http.Server{
+			ReadHeaderTimeout: time.Second,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if len(r.TLS.PeerCertificates) > 0 {
+					fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+				}
+			}),
+		}
+		go func() { _ = server.Serve(tls.NewListener(listener, s.listenerTLSConfig())) }()
+		t.Cleanup(func() { server.Close() })
+		return listener.Addr().String()
+	}
+	request := func(t *testing.T, addr, serverName string, cert *tls.Certificate) (string, string, error) {
+		t.Helper()
+		config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName, RootCAs: ca.pool}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		transport := &http.Transport{TLSClientConfig: config}
+		t.Cleanup(transport.CloseIdleConnections)
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + addr)
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, string(body), nil
+	}
+
+	t.Run("server names", func(t *testing.T) {
+		t.Parallel()
+		addr := serve(t)
+		for serverName, expected := range map[string]string{
+			"app.internal":       "app.internal",
+			"db.lab.internal":    "*.lab.internal",
+			"tsnsrv.example.com": "tsnsrv.example.com",
+		} {
+			served, client, err := request(t, addr, serverName, nil)
+			require.NoError(t, err)
+			assert.Equal(t, expected, served, serverName)
+			assert.Empty(t, client, "client certificates are optional")
+		}
+		_, client, err := request(t, addr, "app.internal", &clientCert)
+		require.NoError(t, err)
+		assert.Equal(t, "client.internal", client)
+		_, _, err = request(t, addr, "app.internal", &strangerCert)
+		require.Error(t, err, "client certificates from other CAs get rejected")
+	})
+	t.Run("required client certificates", func(t *testing.T) {
+		t.Parallel()
+		addr := serve(t, "-requireClientCertificate")
+		_, _, err := request(t, addr, "app.internal", nil)
+		require.Error(t, err)
+		_, client, err := request(t, addr, "app.internal", &clientCert)
+		require.NoError(t, err)
+		assert.Equal(t, "client.internal", client)
+	})
+}
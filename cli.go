@@ -16,14 +16,16 @@ import (
 	"path"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/exp/slog"
 	"golang.org/x/oauth2/clientcredentials"
 	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/client/tailscale/v2"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tsnet"
 	"tailscale.com/types/logger"
 )
@@ -36,9 +38,24 @@ const (
 	matchTsnetOnly
 )
 
+type stripMode int
+
+const (
+	stripDefault stripMode = iota
+	stripAlways
+	stripNever
+)
+
+// prefix is an entry in the route table: It allows requests for a
+// path prefix (and optionally, a host) through, and can send them to
+// an upstream URL of its own.
 type prefix struct {
+	host    string
 	path    string
 	matchIf prefixMatch
+	strip   stripMode
+	grpcWeb bool
+	dest    *url.URL
 }
 
 type strippedPrefixes struct {
@@ -47,34 +64,74 @@ type strippedPrefixes struct {
 }
 
 // matches returns whether an allowlist entry matches a request's URL and circumstance.
-func (pref *prefix) matches(reqURL *url.URL, isFunnel bool) (bool, strippedPrefixes) {
+func (pref *prefix) matches(r *http.Request, isFunnel bool) (bool, strippedPrefixes) {
 	if isFunnel && pref.matchIf == matchTsnetOnly {
 		return false, strippedPrefixes{}
 	}
 	if !isFunnel && pref.matchIf == matchFunnelOnly {
 		return false, strippedPrefixes{}
 	}
+	if pref.host != "" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !strings.EqualFold(host, pref.host) {
+			return false, strippedPrefixes{}
+		}
+	}
 
+	reqURL := r.URL
 	p := strings.TrimPrefix(reqURL.Path, pref.path)
 	rp := strings.TrimPrefix(reqURL.RawPath, pref.path)
 	return len(p) < len(reqURL.Path) && (reqURL.RawPath == "" || len(rp) < len(reqURL.RawPath)), strippedPrefixes{p, rp}
 }
 
+// strips returns whether the entry strips the matched prefix off
+// request paths, given the service's -stripPrefix setting.
+func (pref *prefix) strips(byDefault bool) bool {
+	switch pref.strip {
+	case stripAlways:
+		return true
+	case stripNever:
+		return false
+	case stripDefault:
+	}
+	return byDefault
+}
+
+func (pref *prefix) String() string {
+	var s string
+	switch pref.matchIf {
+	case matchEither:
+	case matchFunnelOnly:
+		s = "funnel:"
+	case matchTsnetOnly:
+		s = "tailnet:"
+	}
+	switch pref.strip {
+	case stripDefault:
+	case stripAlways:
+		s += "strip:"
+	case stripNever:
+		s += "nostrip:"
+	}
+	if pref.grpcWeb {
+		s += "grpcweb:"
+	}
+	s += pref.host + pref.path
+	if pref.dest != nil {
+		s += "=" + pref.dest.String()
+	}
+	return s
+}
+
 type prefixes []prefix
 
 func (p *prefixes) String() string {
 	seq := func(yield func(string) bool) {
 		for _, pref := range *p {
-			var p string
-			switch pref.matchIf {
-			case matchEither:
-				p = pref.path
-			case matchFunnelOnly:
-				p = fmt.Sprintf("funnel:%s", pref.path)
-			case matchTsnetOnly:
-				p = fmt.Sprintf("tailnet:%s", pref.path)
-			}
-			if !yield(p) {
+			if !yield(pref.String()) {
 				return
 			}
 		}
@@ -83,17 +140,52 @@ func (p *prefixes) String() string {
 	return strings.Join(serialized, ", ")
 }
 
+var errPrefixFormat = errors.New("prefixes must look like '[tailnet:|funnel:][strip:|nostrip:][grpcweb:][host]/path[=URL]'")
+
 func (p *prefixes) Set(value string) error {
 	var pref prefix
-	switch {
-	case strings.HasPrefix(value, "tailnet:"):
-		pref.matchIf = matchTsnetOnly
-		pref.path = strings.TrimPrefix(value, "tailnet:")
-	case strings.HasPrefix(value, "funnel:"):
-		pref.matchIf = matchFunnelOnly
-		pref.path = strings.TrimPrefix(value, "funnel:")
-	default:
-		pref.path = value
+	rest := value
+	for {
+		qualifier, after, ok := strings.Cut(rest, ":")
+		if !ok {
+			break
+		}
+		switch qualifier {
+		case "tailnet":
+			pref.matchIf = matchTsnetOnly
+		case "funnel":
+			pref.matchIf = matchFunnelOnly
+		case "strip":
+			pref.strip = stripAlways
+		case "nostrip":
+			pref.strip = stripNever
+		case "grpcweb":
+			pref.grpcWeb = true
+		default:
+			ok = false
+		}
+		if !ok {
+			break
+		}
+		rest = after
+	}
+	route, dest, hasDest := strings.Cut(rest, "=")
+	slash := strings.Index(route, "/")
+	if slash < 0 {
+		return fmt.Errorf("%w: no path in %#v", errPrefixFormat, value)
+	}
+	pref.host, pref.path = route[:slash], route[slash:]
+	if strings.Contains(pref.host, ":") {
+		// Requests are matched on their Host without the port, so a
+		// qualifier with a port could never match.
+		return fmt.Errorf("%w: host %#v must not include a port in %#v", errPrefixFormat, pref.host, value)
+	}
+	if hasDest {
+		destURL, err := url.Parse(dest)
+		if err != nil {
+			return fmt.Errorf("%w: invalid upstream URL in %#v: %w", errPrefixFormat, value, err)
+		}
+		pref.dest = destURL
 	}
 
 	*p = append(*p, pref)
@@ -144,9 +236,44 @@ func (t *tags) Set(value string) error {
 
 type TailnetSrv struct {
 	UpstreamTCPAddr, UpstreamUnixAddr string
+	Upstreams                         upstreamAddrs
+	UpstreamPolicy                    balancePolicy
+	UpstreamProtocol                  upstreamProtocol
+	UpstreamEjectAfter                int
+	UpstreamEjectFor                  time.Duration
+	UpstreamEjectOnStatus             bool
+	HealthCheck                       healthCheck
+	HealthCheckInterval               time.Duration
+	HealthCheckThreshold              int
+	HealthCheckStatus                 statusCodes
+	Allow, Deny                       accessRules
+	UDPIdleTimeout                    time.Duration
+	MaxUpgradesPerIdentity            int
+	RateLimits                        rateLimits
+	AuthURL                           string
+	IdentityToken                     bool
+	IdentityTokenLifetime             time.Duration
+	OIDCPrefix                        string
+	OIDCClients                       oidcClients
+	AuthResponseHeaders               headerNames
+	FunnelAuthFile                    string
+	Webhooks                          webhooks
+	FunnelOIDCIssuer                  string
+	FunnelOIDCClientID                string
+	FunnelOIDCClientSecretFile        string
+	AuthTimeout                       time.Duration
+	FunnelLimits                      serverLimits
+	TailnetLimits                     serverLimits
+	UpgradeIdleTimeout                time.Duration
+	SNIRoutes                         sniRoutes
+	SNICertificates                   sniCertificates
+	ClientCAFile                      string
+	RequireClientCertificate          bool
+	AppCapability                     string
 	Ephemeral                         bool
 	Funnel, FunnelOnly                bool
 	ListenAddr                        string
+	Listeners                         listeners
 	certificateFile                   string
 	keyFile                           string
 	Name                              string
@@ -159,6 +286,10 @@ type TailnetSrv struct {
 	AuthkeyPath                       string
 	Tags                              tags
 	InsecureHTTPS                     bool
+	UpstreamCertificateFile           string
+	UpstreamKeyFile                   string
+	UpstreamCAFile                    string
+	UpstreamServerName                string
 	WhoisTimeout                      time.Duration
 	SuppressWhois                     bool
 	PrometheusAddr                    string
@@ -166,6 +297,7 @@ type TailnetSrv struct {
 	UpstreamHeaders                   headers
 	SuppressTailnetDialer             bool
 	ReadHeaderTimeout                 time.Duration
+	ShutdownTimeout                   time.Duration
 	TsnetVerbose                      bool
 	UpstreamAllowInsecureCiphers      bool
 }
@@ -177,43 +309,107 @@ type ValidTailnetSrv struct {
 	TailnetSrv
 	DestURL *url.URL
 	client  *local.Client
+	whois   func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+	// The running service's node and handlers, shared with the
+	// configurations that replace this one when reloading:
+	srv            *tsnet.Server
+	handlers       []*handlerSwitch // one for each of the Listeners
+	transport      *upstreamPool
+	upgrades       *openCounts
+	requests       *openCounts // requests in flight, by source and address
+	rateLimiters   *rateLimiters
+	upstreamTLS    *upstreamTLSFiles
+	identityKey    *identityKey
+	oidcSecrets    map[string]string // by -oidcClient ID
+	oidcGrants     *oidcGrants
+	funnelAuth     *funnelAuth
+	sessionKey     []byte   // signs -funnelOIDCIssuer sessions
+	webhookSecrets [][]byte // one for each of the Webhooks
+	certs          *listenerCerts
 }
 
-// TailnetSrvFromArgs constructs a validated tailnet service from commandline arguments.
-func TailnetSrvFromArgs(args []string) (*ValidTailnetSrv, *ffcli.Command, error) {
-	s := &TailnetSrv{}
+// flagSet returns the flags that configure a single tailnet service, writing to s.
+func (s *TailnetSrv) flagSet() *flag.FlagSet {
 	fs := flag.NewFlagSet("tsnsrv", flag.ExitOnError)
 	fs.StringVar(&s.UpstreamTCPAddr, "upstreamTCPAddr", "", "Proxy to an HTTP service listening on this TCP address")
 	fs.StringVar(&s.UpstreamUnixAddr, "upstreamUnixAddr", "", "Proxy to an HTTP service listening on this UNIX domain socket address")
+	fs.Var(&s.Upstreams, "upstream", "Balance requests across upstream addresses, given as 'tcp:<host:port>', 'unix:<path>' or 'tailnet:<host:port>'; can be given several times")
+	fs.Var(&s.UpstreamPolicy, "upstreamPolicy", "How to balance requests across -upstream addresses: roundRobin, leastConnections or identityHash")
+	fs.Var(&s.UpstreamProtocol, "upstreamProtocol", "Protocol to speak to upstream services: http1, h2c (HTTP/2 without TLS, for http:// destinations) or h2 (HTTP/2 over TLS, for https:// destinations)")
+	fs.IntVar(&s.UpstreamEjectAfter, "upstreamEjectAfter", 3, "Eject upstream addresses from the pool after this many failures in a row; 0 to never eject them")
+	fs.DurationVar(&s.UpstreamEjectFor, "upstreamEjectFor", 30*time.Second, "Amount of time to eject failing upstream addresses from the pool for")
+	fs.BoolVar(&s.UpstreamEjectOnStatus, "upstreamEjectOnStatus", false, "Also count 502, 503 and 504 responses from upstream addresses as failures toward -upstreamEjectAfter")
+	fs.Var(&s.HealthCheck, "healthCheck", "Probe each upstream address with 'http:<path>' requests, or by opening a connection to it with 'connect'")
+	fs.DurationVar(&s.HealthCheckInterval, "healthCheckInterval", 10*time.Second, "Amount of time between health checks, and the maximum time each may take")
+	fs.IntVar(&s.HealthCheckThreshold, "healthCheckThreshold", 3, "Number of health checks in a row that need to fail (or pass) before an upstream address counts as unhealthy (or healthy)")
+	s.HealthCheckStatus = statusCodes{"2xx", "3xx"}
+	fs.Var(&s.HealthCheckStatus, "healthCheckStatus", "Comma-separated HTTP status codes (or classes like 2xx) that http health checks expect")
 	fs.BoolVar(&s.Ephemeral, "ephemeral", false, "Declare this service ephemeral")
 	fs.BoolVar(&s.Funnel, "funnel", false, "Expose a funnel service.")
 	fs.BoolVar(&s.FunnelOnly, "funnelOnly", false, "Expose a funnel service only (not exposed on the tailnet).")
 	fs.StringVar(&s.ListenAddr, "listenAddr", ":443", "Address to listen on; note only :443, :8443 and :10000 are supported with -funnel.")
+	fs.Var(&s.Listeners, "listen", "Listen on an address, as '<addr>[,tls|plaintext|funnel|redirect|tcp|udp|passthrough][,prefix=<prefix>...]'; can be given several times and replaces -listenAddr, -plaintext, -funnel and -funnelOnly")
 	fs.StringVar(&s.certificateFile, "certificateFile", "", "Custom certificate file to use for TLS listening instead of Tailscale's builtin way.")
 	fs.StringVar(&s.keyFile, "keyFile", "", "Custom key file to use for TLS listening instead of Tailscale's builtin way.")
+	fs.Var(&s.SNICertificates, "sniCertificate", "Serve a certificate on TLS listeners to clients asking for a server name (or '*.<domain>'), as '<server name>=<certificate file>,<key file>'; can be given several times")
+	fs.StringVar(&s.ClientCAFile, "clientCAFile", "", "Verify the certificates that clients present on TLS listeners against the PEM-encoded CA certificates in this file")
+	fs.BoolVar(&s.RequireClientCertificate, "requireClientCertificate", false, "Reject clients on TLS listeners that present no certificate issued by the -clientCAFile")
 	fs.StringVar(&s.Name, "name", "", "Name of this service")
 	fs.BoolVar(&s.RecommendedProxyHeaders, "recommendedProxyHeaders", true, "Set Host, X-Scheme, X-Real-Ip, X-Forwarded-{Proto,Server,Port} headers.")
 	fs.BoolVar(&s.ServePlaintext, "plaintext", false, "Serve plaintext HTTP without TLS")
 	fs.DurationVar(&s.Timeout, "timeout", 1*time.Minute, "Timeout connecting to the tailnet")
-	fs.Var(&s.AllowedPrefixes, "prefix", "Allowed URL prefixes; if none is set, all prefixes are allowed")
+	fs.Var(&s.AllowedPrefixes, "prefix", "Allowed URL prefixes, as '[tailnet:|funnel:][strip:|nostrip:][grpcweb:][host]/path[=URL]', optionally with an upstream URL of their own and translating gRPC-Web requests; if none is set, all prefixes are allowed")
 	fs.BoolVar(&s.StripPrefix, "stripPrefix", true, "Strip prefixes that matched; best set to false if allowing multiple prefixes")
 	fs.StringVar(&s.StateDir, "stateDir", os.Getenv("TS_STATE_DIR"), "Directory containing the persistent tailscale status files. Can also be set by $TS_STATE_DIR; this option takes precedence.")
 	fs.StringVar(&s.AuthkeyPath, "authkeyPath", "", "File containing a tailscale auth key. Key is assumed to be in $TS_AUTHKEY in absence of this option.")
 	fs.Var(&s.Tags, "tag", "Tags to advertise to tailscale. Mandatory if using OAuth clients.")
 	fs.BoolVar(&s.InsecureHTTPS, "insecureHTTPS", false, "Disable TLS certificate validation on upstream")
+	fs.StringVar(&s.UpstreamCertificateFile, "upstreamCertificateFile", "", "Client certificate file to present to upstream HTTPS services (for mutual TLS)")
+	fs.StringVar(&s.UpstreamKeyFile, "upstreamKeyFile", "", "Key file for the -upstreamCertificateFile")
+	fs.StringVar(&s.UpstreamCAFile, "upstreamCAFile", "", "File with the PEM-encoded CA certificates that upstream HTTPS services' certificates must be issued by, instead of the system's")
+	fs.StringVar(&s.UpstreamServerName, "upstreamServerName", "", "Server name that upstream HTTPS services' certificates must be valid for (and that gets sent as SNI), instead of the destination URL's host")
 	fs.DurationVar(&s.WhoisTimeout, "whoisTimeout", 1*time.Second, "Maximum amount of time to spend looking up client identities")
 	fs.BoolVar(&s.SuppressWhois, "suppressWhois", false, "Do not set X-Tailscale-User-* headers in upstream requests")
+	fs.Var(&s.Allow, "allow", "Only allow requests (under an optional /path=) from these comma-separated users (user:<login>), login domains (domain:<domain>), node tags (tag:<tag>), nodes (node:<name>) or -appCapability roles (role:<role>); can be given several times")
+	fs.Var(&s.Deny, "deny", "Deny requests (under an optional /path=) from these comma-separated users, login domains, node tags, nodes or roles, as in -allow; can be given several times")
+	fs.StringVar(&s.AppCapability, "appCapability", "", "Only allow requests that grants of this app capability (e.g. example.com/cap/tsnsrv) in the tailnet policy file cover, and pass the grants upstream")
 	fs.StringVar(&s.PrometheusAddr, "prometheusAddr", ":9099", "Serve prometheus metrics from this address. Empty string to disable.")
 	fs.BoolVar(&s.EnableBugReports, "enableBugReports", false, "Allow POST /bugreport on the prometheus address to submit debug logs to the Tailscale API")
 	fs.Var(&s.UpstreamHeaders, "upstreamHeader", "Additional headers (separated by ': ') on requests to upstream.")
 	fs.BoolVar(&s.SuppressTailnetDialer, "suppressTailnetDialer", false, "Whether to use the stdlib net.Dialer instead of a tailnet-enabled one")
 	fs.DurationVar(&s.ReadHeaderTimeout, "readHeaderTimeout", 0, "Amount of time to allow for reading HTTP request headers. 0 will disable the timeout but expose the service to the slowloris attack.")
+	fs.Var(&s.SNIRoutes, "sniRoute", "Send passthrough connections for a TLS server name (or '*.<domain>') to an upstream address, as '<server name>=<upstream address>'; can be given several times")
+	fs.DurationVar(&s.UDPIdleTimeout, "udpIdleTimeout", 1*time.Minute, "Amount of time after which UDP flows without any datagrams in either direction end")
+	fs.BoolVar(&s.IdentityToken, "identityToken", false, "Pass a signed JWT asserting the requestor's identity upstream, in the X-Tailscale-Identity-Token header; the admin listener on -prometheusAddr serves the keys that verify it at /.well-known/jwks.json, and they're also written to tsnsrv-identity-jwks.json in the -stateDir")
+	fs.DurationVar(&s.IdentityTokenLifetime, "identityTokenLifetime", time.Minute, "Amount of time that -identityToken tokens are valid for")
+	fs.StringVar(&s.OIDCPrefix, "oidcPrefix", "", "Serve an OIDC provider that logs tailnet users in as themselves under this path prefix (e.g. /oidc) on the tailnet listeners")
+	fs.Var(&s.OIDCClients, "oidcClient", "Let an app log users in with the -oidcPrefix provider, as '<client id>:<client secret file>=<redirect URI>[,<redirect URI>...]'; can be given several times")
+	fs.StringVar(&s.AuthURL, "authURL", "", "Ask this http:// or https:// URL whether to let each request through, with its method, URI and requestor identity; a 2xx status lets it through, and anything else is returned to the client")
+	fs.Var(&s.AuthResponseHeaders, "authResponseHeader", "Comma-separated headers to copy from the -authURL's answers onto requests going upstream; can be given several times")
+	fs.DurationVar(&s.AuthTimeout, "authTimeout", 5*time.Second, "Maximum amount of time to wait for the -authURL to answer")
+	fs.Var(&s.Webhooks, "webhook", "Reject requests under a path that don't carry a valid webhook signature, as '/path=github|gitlab|stripe|slack|hmac:<secret file>[,maxAge=<duration>]' (hmac webhooks can also set ',header=<name>' for the signature and ',timestampHeader=<name>'); can be given several times")
+	fs.StringVar(&s.FunnelAuthFile, "funnelAuthFile", "", "Make requests coming in via the funnel authenticate with a user from this file, whose lines look like '<user> basic <bcrypt hash>' or '<user> bearer <token>'")
+	fs.StringVar(&s.FunnelOIDCIssuer, "funnelOIDCIssuer", "", "Make requests coming in via the funnel authenticate by logging in with this OIDC issuer URL (or with a user from the -funnelAuthFile); every account at the issuer gets in, unless -allow funnel:<login> rules narrow it down")
+	fs.StringVar(&s.FunnelOIDCClientID, "funnelOIDCClientID", "", "Client ID that tsnsrv logs funnel users in with at the -funnelOIDCIssuer")
+	fs.StringVar(&s.FunnelOIDCClientSecretFile, "funnelOIDCClientSecretFile", "", "File containing the client secret that tsnsrv logs funnel users in with at the -funnelOIDCIssuer")
+	fs.Var(&s.RateLimits, "rateLimit", "Limit requests (under an optional /path=) from each user, node or tag on the tailnet (and each client address on the funnel), as '[/path=]<requests>/s|m|h[,burst=<requests>][,by=login|node|tag]'; can be given several times")
+	fs.Var(&s.FunnelLimits, "funnelLimits", "Limit requests coming in via the funnel, as comma-separated 'maxBody=<bytes>', 'maxHeader=<bytes>', 'readTimeout=<duration>', 'writeTimeout=<duration>', 'idleTimeout=<duration>', 'maxRequests=<count>' (in flight) and 'maxRequestsPerAddr=<count>' (in flight from each client address)")
+	fs.Var(&s.TailnetLimits, "tailnetLimits", "Limit requests coming in from the tailnet, like -funnelLimits")
+	fs.IntVar(&s.MaxUpgradesPerIdentity, "maxUpgradesPerIdentity", 0, "Maximum number of upgraded (e.g. WebSocket) connections that each user (or, on the funnel, each client address) can have open at once; 0 for no limit")
+	fs.DurationVar(&s.UpgradeIdleTimeout, "upgradeIdleTimeout", 0, "Amount of time after which upgraded (e.g. WebSocket) connections without any data in either direction get closed; 0 to never close them")
+	fs.DurationVar(&s.ShutdownTimeout, "shutdownTimeout", 30*time.Second, "Amount of time to wait for requests in flight to finish when shutting down.")
 	fs.BoolVar(&s.TsnetVerbose, "tsnetVerbose", false, "Whether to output tsnet logs.")
 	fs.BoolVar(&s.UpstreamAllowInsecureCiphers, "upstreamAllowInsecureCiphers", false, "Don't require Perfect Forward Secrecy from the upstream https server.")
+	return fs
+}
 
+// TailnetSrvFromArgs constructs a validated tailnet service from commandline arguments.
+func TailnetSrvFromArgs(args []string) (*ValidTailnetSrv, *ffcli.Command, error) {
+	s := &TailnetSrv{}
 	root := &ffcli.Command{
 		ShortUsage: fmt.Sprintf("%s -name <serviceName> [flags] <toURL>", path.Base(args[0])),
-		FlagSet:    fs,
+		FlagSet:    s.flagSet(),
 		Exec:       func(context.Context, []string) error { return nil },
 	}
 	if err := root.Parse(args[1:]); err != nil {
@@ -230,9 +426,10 @@ var errNameRequired = errors.New("tsnsrv needs a -name")
 var errNoPlaintextOnFunnel = errors.New("can not serve plaintext on a funnel service")
 var errBothCertificateFileKeyFile = errors.New("when providing either a certificate or key file, the other must be provided")
 var errNoPlaintextWithCustomCert = errors.New("can not serve plaintext when using custom certificate and key")
-var errOnlyOneAddrType = errors.New("can only proxy to one address at a time, pass either -upstreamUnixAddr or -upstreamTCPAddr")
+var errOnlyOneAddrType = errors.New("can only proxy to one address at a time, pass either -upstreamUnixAddr, -upstreamTCPAddr or -upstream")
 var errFunnelRequired = errors.New("-funnel is required if -funnelOnly is set")
 var errNoDestURL = errors.New("tsnsrv requires a destination URL")
+var errUpstreamProtocolScheme = errors.New("the upstream protocol does not match the destination URL")
 
 func (s *TailnetSrv) validate(args []string) (*ValidTailnetSrv, error) {
 	var errs []error
@@ -248,12 +445,36 @@ func (s *TailnetSrv) validate(args []string) (*ValidTailnetSrv, error) {
 	if s.ServePlaintext && s.certificateFile != "" && s.keyFile != "" {
 		errs = append(errs, errNoPlaintextWithCustomCert)
 	}
-	if s.UpstreamTCPAddr != "" && s.UpstreamUnixAddr != "" {
+	if s.RequireClientCertificate && s.ClientCAFile == "" {
+		errs = append(errs, errClientCertificateNeedsCA)
+	}
+	errs = append(errs, s.validateOIDC()...)
+	if s.translatesGRPCWeb() && s.UpstreamProtocol == protocolHTTP1 {
+		errs = append(errs, errGRPCWebNeedsHTTP2)
+	}
+	if s.IdentityToken && s.PrometheusAddr == "" {
+		errs = append(errs, errIdentityTokenNeedsAdmin)
+	}
+	errs = append(errs, s.validateFunnelAuth()...)
+	if err := validateAuthURL(s.AuthURL); err != nil {
+		errs = append(errs, err)
+	}
+	if (s.UpstreamCertificateFile == "") != (s.UpstreamKeyFile == "") {
+		errs = append(errs, errBothUpstreamCertificateFileKeyFile)
+	}
+	if s.UpstreamTCPAddr != "" && s.UpstreamUnixAddr != "" || (s.UpstreamTCPAddr != "" || s.UpstreamUnixAddr != "") && len(s.Upstreams) > 0 {
 		errs = append(errs, errOnlyOneAddrType)
 	}
 	if !s.Funnel && s.FunnelOnly {
 		errs = append(errs, errFunnelRequired)
 	}
+	if s.HealthCheck.kind != healthCheckNone && (s.HealthCheckInterval <= 0 || s.HealthCheckThreshold < 1) {
+		errs = append(errs, errHealthCheckSettings)
+	}
+	errs = append(errs, s.validateListeners()...)
+	if len(s.SNIRoutes) > 0 && !slices.ContainsFunc(s.Listeners, func(l listener) bool { return l.mode == listenPassthrough }) {
+		errs = append(errs, errSNIRoutesNeedPassthrough)
+	}
 
 	if len(args) != 1 {
 		return nil, errors.Join(append(errs, errNoDestURL)...)
@@ -261,12 +482,14 @@ func (s *TailnetSrv) validate(args []string) (*ValidTailnetSrv, error) {
 	destURL, err := url.Parse(args[0])
 	if err != nil {
 		errs = append(errs, fmt.Errorf("invalid destination URL %#v: %w", args[0], err))
+	} else if scheme := s.UpstreamProtocol.scheme(); scheme != "" && destURL.Scheme != scheme {
+		errs = append(errs, fmt.Errorf("%w: %v needs a %v:// destination URL", errUpstreamProtocolScheme, &s.UpstreamProtocol, scheme))
 	}
 	if len(errs) > 0 {
 		return nil, errors.Join(errs...)
 	}
 
-	valid := ValidTailnetSrv{TailnetSrv: *s, DestURL: destURL}
+	valid := ValidTailnetSrv{TailnetSrv: *s, DestURL: destURL, upgrades: &openCounts{}, requests: &openCounts{}, rateLimiters: &rateLimiters{}, oidcGrants: &oidcGrants{}}
 	return &valid, nil
 }
 
@@ -317,7 +540,28 @@ func (s *ValidTailnetSrv) mintAuthKey(ctx context.Context, authkey string) (stri
 	return created.Key, nil
 }
 
+// Run connects the service to the tailnet and serves requests until an error occurs.
 func (s *ValidTailnetSrv) Run(ctx context.Context) error {
+	services := Services{
+		Services:         []*ValidTailnetSrv{s},
+		PrometheusAddr:   s.PrometheusAddr,
+		EnableBugReports: s.EnableBugReports,
+	}
+	return services.Run(ctx)
+}
+
+// log returns the logger that messages about this service should go to.
+func (s *ValidTailnetSrv) log() *slog.Logger {
+	return serviceLog(s.Name)
+}
+
+// serviceLog returns the logger for messages about the named service.
+func serviceLog(name string) *slog.Logger {
+	return slog.Default().With("service", name)
+}
+
+// start brings the service's node up on the tailnet.
+func (s *ValidTailnetSrv) start(ctx context.Context) (*ipnstate.Status, error) {
 	srv := &tsnet.Server{
 		Hostname:   s.Name,
 		Dir:        s.StateDir,
@@ -327,13 +571,13 @@ func (s *ValidTailnetSrv) Run(ctx context.Context) error {
 	}
 	if s.TsnetVerbose {
 		slog.SetDefault(slog.Default())
-		srv.Logf = log.Printf
+		srv.Logf = logger.WithPrefix(log.Printf, s.Name+": ")
 	}
 	if s.AuthkeyPath != "" {
 		var err error
 		srv.AuthKey, err = s.authkeyFromFile(ctx, s.AuthkeyPath)
 		if err != nil {
-			slog.Warn("Could not read authkey from file",
+			s.log().Warn("Could not read authkey from file",
 				"path", s.AuthkeyPath,
 				"error", err)
 		}
@@ -342,149 +586,261 @@ func (s *ValidTailnetSrv) Run(ctx context.Context) error {
 	defer cancel()
 	status, err := srv.Up(ctx)
 	if err != nil {
-		return fmt.Errorf("could not connect to tailnet: %w", err)
+		return nil, fmt.Errorf("could not connect to tailnet: %w", err)
 	}
+	s.srv = srv
 	s.client, err = srv.LocalClient()
 	if err != nil {
-		if slices.ContainsFunc(s.AllowedPrefixes, func(p prefix) bool { return p.matchIf != matchEither }) {
-			return fmt.Errorf("-prefix rules with a provenance (tailnet: or funnel:) require that a local tailscale client is available: %w", err)
-		}
-		slog.Warn("could not get a local tailscale client. Whois headers will not work.",
+		s.log().Warn("could not get a local tailscale client. Whois headers will not work.",
 			"error", err,
 		)
 	}
-	dial := srv.Dial
-	if s.SuppressTailnetDialer {
-		d := net.Dialer{}
-		dial = d.DialContext
+	return status, nil
+}
+
+var errProvenanceNeedsClient = errors.New("-prefix rules with a provenance (tailnet: or funnel:) require that a local tailscale client is available")
+var errAccessRulesNeedClient = errors.New("-allow, -deny and -appCapability rules require that a local tailscale client is available")
+
+// activate builds the service's request handlers and switches its
+// listeners over to them.
+func (s *ValidTailnetSrv) activate() error {
+	install, err := s.prepare()
+	if err != nil {
+		return err
 	}
-	if s.UpstreamTCPAddr != "" {
-		dialOrig := dial
-		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
-			conn, err := dialOrig(ctx, "tcp", s.UpstreamTCPAddr)
-			if err != nil {
-				return nil, fmt.Errorf("connecting to tcp %v: %w", s.UpstreamTCPAddr, err)
-			}
-			return conn, nil
-		}
-	} else if s.UpstreamUnixAddr != "" {
-		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
-			d := net.Dialer{}
-			conn, err := d.DialContext(ctx, "unix", s.UpstreamUnixAddr)
-			if err != nil {
-				return nil, fmt.Errorf("connecting to unix %v: %w", s.UpstreamUnixAddr, err)
-			}
-			return conn, nil
-		}
+	install()
+	return nil
+}
+
+// prepare loads everything that the service's request handlers need,
+// and returns a function that builds them and switches the listeners
+// over to them. That function can't fail, and until it's called,
+// requests and connections keep going to the previous handlers.
+func (s *ValidTailnetSrv) prepare() (func(), error) {
+	if s.client == nil && s.needsProvenance() {
+		return nil, errProvenanceNeedsClient
 	}
-	transport := &http.Transport{DialContext: dial}
-	transport.TLSClientConfig = &tls.Config{
-		MinVersion: tls.VersionTLS12,
+	if s.client != nil {
+		s.whois = s.client.WhoIs
 	}
-	if s.InsecureHTTPS {
-		transport.TLSClientConfig.InsecureSkipVerify = true // #nosec This is explicitly requested by the user
+	if s.whois == nil && s.hasAccessRules() {
+		return nil, errAccessRulesNeedClient
 	}
-	if s.UpstreamAllowInsecureCiphers {
-		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
-			transport.TLSClientConfig.CipherSuites = append(transport.TLSClientConfig.CipherSuites, suite.ID)
-		}
+	if err := s.loadUpstreamTLS(); err != nil {
+		return nil, err
 	}
-	err = s.setupPrometheus(srv)
-	if err != nil {
-		slog.Error("Could not setup prometheus listener", "error", err)
+	if err := s.loadIdentityKey(); err != nil {
+		return nil, err
+	}
+	if err := s.loadOIDCSecrets(); err != nil {
+		return nil, err
+	}
+	if err := s.loadFunnelAuth(); err != nil {
+		return nil, err
+	}
+	if err := s.loadWebhookSecrets(); err != nil {
+		return nil, err
 	}
+	return func() {
+		if s.handlers == nil {
+			for range s.Listeners {
+				s.handlers = append(s.handlers, &handlerSwitch{})
+			}
+		}
+		transport := s.newTransport()
+		transport.checkHealth(s)
+		router := s.newSNIRouter(transport)
+		for i := range s.Listeners {
+			if s.Listeners[i].forwardsConns() {
+				s.handlers[i].StoreConns(&forwarder{s: s, pool: transport, router: router, mode: s.Listeners[i].mode})
+				continue
+			}
+			s.handlers[i].Store(s.handler(transport, &s.Listeners[i]))
+		}
+		s.transport = transport
+	}, nil
+}
+
+// needsProvenance returns whether any prefix rules distinguish
+// between requests from the tailnet and from the funnel.
+func (s *ValidTailnetSrv) needsProvenance() bool {
+	hasProvenance := func(p prefix) bool { return p.matchIf != matchEither }
+	return slices.ContainsFunc(s.AllowedPrefixes, hasProvenance) ||
+		slices.ContainsFunc(s.Listeners, func(l listener) bool { return slices.ContainsFunc(l.prefixes, hasProvenance) })
+}
 
-	slog.Info("Serving",
+// newTransport returns a transport that makes requests to the upstream service.
+func (s *ValidTailnetSrv) newTransport() *upstreamPool {
+	return s.newPool(func(dial dialFunc) *http.Transport {
+		return &http.Transport{
+			DialContext:     dial,
+			Protocols:       s.UpstreamProtocol.protocols(),
+			TLSClientConfig: s.upstreamTLSConfig(),
+		}
+	})
+}
+
+// serve proxies requests arriving on the service's node until an
+// error occurs, or until ctx is done; it then shuts down gracefully.
+func (s *ValidTailnetSrv) serve(ctx context.Context, status *ipnstate.Status) error {
+	srv := s.srv
+	s.log().Info("Serving",
 		"name", s.Name,
 		"tailscaleIPs", status.TailscaleIPs,
-		"listenAddr", s.ListenAddr,
+		"listeners", &s.Listeners,
 		"tags", s.Tags,
 		"prefixes", s.AllowedPrefixes,
 		"destURL", s.DestURL,
-		"plaintext", s.ServePlaintext,
-		"funnel", s.Funnel,
-		"funnelOnly", s.FunnelOnly,
 	)
-	tailnetServer := http.Server{
-		Handler:           s.mux(transport, false),
-		ReadHeaderTimeout: s.ReadHeaderTimeout,
-	}
-	funnelServer := http.Server{
-		Handler:           s.mux(transport, true),
-		ReadHeaderTimeout: s.ReadHeaderTimeout,
-	}
-
-	serveResults := make(chan error)
-	if s.Funnel {
+	if err := s.loadListenerCerts(ctx); err != nil {
+		s.shutdown(context.WithoutCancel(ctx), nil)
+		return err
+	}
+	servers := make([]server, len(s.Listeners))
+	serveResults := make(chan error, len(s.Listeners))
+	for i, l := range s.Listeners {
+		servers[i] = s.newServer(l, s.handlers[i])
 		go func() {
-			serveResults <- fmt.Errorf("on the funnel for %v: %w", srv, func() error {
-				listener, err := srv.ListenFunnel("tcp", s.ListenAddr, tsnet.FunnelOnly())
-				if err != nil {
-					return fmt.Errorf("creating funnel listener for %v: %w", srv, err)
-				}
-				return funnelServer.Serve(listener)
-			}())
+			serveResults <- fmt.Errorf("on %v for %v: %w", l.endpoint(), srv, s.listen(servers[i], l))
 		}()
 	}
-	if s.FunnelOnly {
-		return fmt.Errorf("while serving: %w", <-serveResults)
+	select {
+	case err := <-serveResults:
+		// Stop the other listeners, and close (and log out) the node:
+		s.shutdown(context.WithoutCancel(ctx), servers)
+		return fmt.Errorf("while serving: %w", err)
+	case <-ctx.Done():
+		s.shutdown(context.WithoutCancel(ctx), servers)
+		return nil
 	}
+}
 
-	go func() {
-		serveResults <- fmt.Errorf("on the tailnet for %v: %w", srv, func() error {
-			if s.certificateFile != "" || s.keyFile != "" {
-				listener, err := srv.Listen("tcp", s.ListenAddr)
-				if err != nil {
-					return fmt.Errorf("creating custom-cert TLS listener on the tailnet: %w", err)
-				}
-				return tailnetServer.ServeTLS(listener, s.certificateFile, s.keyFile)
-			}
+// server serves the connections (or packets) arriving on a
+// listener, until it gets shut down.
+type server interface {
+	Shutdown(ctx context.Context) error
+}
 
-			listen := func() (net.Listener, error) { return srv.ListenTLS("tcp", s.ListenAddr) }
-			if s.ServePlaintext {
-				listen = func() (net.Listener, error) { return srv.Listen("tcp", s.ListenAddr) }
-			}
-			listener, err := listen()
-			if err != nil {
-				return fmt.Errorf("creating listener on the tailnet: %w", err)
-			}
-			return tailnetServer.Serve(listener)
-		}())
-	}()
-	return fmt.Errorf("while serving: %w", <-serveResults)
+// streamServer serves the connections from a net.Listener. Both
+// http.Server and connServer are streamServers.
+type streamServer interface {
+	server
+	Serve(l net.Listener) error
 }
 
-func (s *ValidTailnetSrv) setupPrometheus(srv *tsnet.Server) error {
-	if s.PrometheusAddr == "" {
-		return nil
+// newServer returns the server for the listener l, which passes
+// requests or connections on to handler.
+func (s *ValidTailnetSrv) newServer(l listener, handler *handlerSwitch) server {
+	switch {
+	case l.mode == listenUDP:
+		return &packetServer{handler: handler}
+	case l.forwardsConns():
+		return &connServer{handler: handler}
+	}
+	// Plaintext listeners accept HTTP/2 with prior knowledge (h2c),
+	// for gRPC clients that rely on the tailnet's encryption:
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	limits := s.limits(l.forFunnel())
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       limits.readTimeout,
+		WriteTimeout:      limits.writeTimeout,
+		IdleTimeout:       limits.idleTimeout,
+		MaxHeaderBytes:    limits.maxHeader,
+		Protocols:         &protocols,
 	}
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	if s.EnableBugReports {
-		mux.HandleFunc("POST /bugreport", func(w http.ResponseWriter, r *http.Request) {
-			lcl, err := srv.LocalClient()
-			if err != nil {
-				slog.Error("failed to retrieve local tailscale client", "error", err)
-			}
-			reportID, err := lcl.BugReport(r.Context(), "")
+}
+
+// listen serves requests with server on the listener l.
+func (s *ValidTailnetSrv) listen(server server, l listener) error {
+	if l.mode == listenUDP {
+		return s.listenPackets(server.(*packetServer), l)
+	}
+	listener, err := s.netListener(l)
+	if err != nil {
+		return err
+	}
+	return server.(streamServer).Serve(listener)
+}
+
+// netListener returns a net.Listener for the stream listener l.
+func (s *ValidTailnetSrv) netListener(l listener) (net.Listener, error) {
+	srv := s.srv
+	switch l.mode {
+	case listenFunnel:
+		opts := []tsnet.FunnelOption{tsnet.FunnelOnly()}
+		if s.client != nil {
+			opts = append(opts, tsnet.FunnelTLSConfig(s.tailnetTLSConfig()))
+		}
+		listener, err := srv.ListenFunnel("tcp", l.addr, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("creating funnel listener for %v: %w", srv, err)
+		}
+		return listener, nil
+	case listenTLS:
+		if s.client != nil || s.certs.custom != nil || len(s.certs.sni) > 0 {
+			listener, err := srv.Listen("tcp", l.addr)
 			if err != nil {
-				slog.Error("failed to submit bug report logs to tailscale API", "error", err)
+				return nil, fmt.Errorf("creating TLS listener on the tailnet: %w", err)
 			}
-			slog.Info("Submitted bug report logs to tailscale API", "report", reportID)
-			_, _ = w.Write([]byte(reportID))
-		})
+			return tls.NewListener(listener, s.listenerTLSConfig()), nil
+		}
+		listener, err := srv.ListenTLS("tcp", l.addr)
+		if err != nil {
+			return nil, fmt.Errorf("creating listener on the tailnet: %w", err)
+		}
+		return listener, nil
+	case listenPlaintext, listenRedirect, listenTCP, listenUDP, listenPassthrough:
 	}
-	listener, err := srv.Listen("tcp", s.PrometheusAddr)
+	listener, err := srv.Listen("tcp", l.addr)
 	if err != nil {
-		return fmt.Errorf("could not listen on prometheus address %v: %w", s.PrometheusAddr, err)
+		return nil, fmt.Errorf("creating listener on the tailnet: %w", err)
 	}
-	go func() {
-		server := http.Server{
-			Handler:           mux,
-			ReadHeaderTimeout: 1 * time.Second,
+	return listener, nil
+}
+
+// tailnetTLSConfig returns the TLS config for listeners with the
+// node's tailscale certificate. Unlike tsnet's, it offers HTTP/2 to
+// clients, which gRPC needs.
+func (s *ValidTailnetSrv) tailnetTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.client.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// shutdown stops the service's servers from accepting new requests,
+// waits up to the shutdown timeout for requests in flight to finish,
+// and then takes the service's node off the tailnet.
+func (s *ValidTailnetSrv) shutdown(ctx context.Context, servers []server) {
+	s.log().Info("Shutting down", "timeout", s.ShutdownTimeout)
+	drainCtx, cancel := context.WithTimeout(ctx, s.ShutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(drainCtx); err != nil {
+				s.log().Warn("Could not finish serving requests in flight", "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.Ephemeral && s.client != nil {
+		logoutCtx, cancel := context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+		if err := s.client.Logout(logoutCtx); err != nil {
+			s.log().Warn("Could not log out ephemeral node", "error", err)
 		}
-		slog.Error("failed to listen on prometheus address", "error", server.Serve(listener))
-		os.Exit(20)
-	}()
-	return nil
+	}
+	if err := s.srv.Close(); err != nil {
+		s.log().Warn("Could not close tailnet node", "error", err)
+	}
 }
@@ -273,3 +273,105 @@ func TestCustomHeaders(t *testing.T) {
 		})
 	}
 }
+
+func TestPrefixFormat(t *testing.T) {
+	for _, elt := range []struct {
+		value string
+		ok    bool
+	}{
+		{"/", true},
+		{"tailnet:/api", true},
+		{"funnel:nostrip:/_matrix=http://127.0.0.1:8008", true},
+		{"strip:grafana.example.com/=http://127.0.0.1:3000/grafana", true},
+		{"/a:b=unix:/run/foo.sock", true},
+		{"tailnet:grpcweb:/api=http://127.0.0.1:50051", true},
+
+		// Expected to fail:
+		{"no-path", false},
+		{"tailnet:no-path", false},
+		{"/api=::--example.com", false},
+		{"example.com:8080/x", false},
+	} {
+		test := elt
+		t.Run(test.value, func(t *testing.T) {
+			t.Parallel()
+			var p prefixes
+			err := p.Set(test.value)
+			if !test.ok {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.value, p.String())
+		})
+	}
+}
+
+func TestRouteTable(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s:%s", name, r.URL.Path)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	ui, hooks, grafana := upstream("ui"), upstream("hooks"), upstream("grafana")
+
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "TestRouteTable",
+		"-prefix", "funnel:/webhook=" + hooks.URL,
+		"-prefix", "nostrip:grafana.example.com/=" + grafana.URL,
+		"-prefix", "tailnet:strip:/ui",
+		"-stripPrefix=false",
+		ui.URL,
+	})
+	require.NoError(t, err)
+
+	for _, elt := range []struct {
+		name, host, path string
+		funnel           bool
+		expected         string
+	}{
+		{"default upstream", "", "/ui/index.html", false, "ui:/index.html"},
+		{"webhook on the funnel", "", "/webhook/github", true, "hooks:/webhook/github"},
+		{"by host", "grafana.example.com", "/d/foo", false, "grafana:/d/foo"},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			proxy := httptest.NewServer(s.mux(http.DefaultTransport, test.funnel))
+			defer proxy.Close()
+			req, err := http.NewRequest(http.MethodGet, proxy.URL+test.path, nil)
+			require.NoError(t, err)
+			if test.host != "" {
+				req.Host = test.host
+			}
+			resp, err := proxy.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(body))
+		})
+	}
+
+	// Routes only apply where their provenance and host allow them:
+	for _, elt := range []struct {
+		name, path string
+		funnel     bool
+	}{
+		{"webhook on the tailnet", "/webhook/github", false},
+		{"ui on the funnel", "/ui/index.html", true},
+		{"grafana path on another host", "/d/foo", false},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			proxy := httptest.NewServer(s.mux(http.DefaultTransport, test.funnel))
+			defer proxy.Close()
+			resp, err := proxy.Client().Get(proxy.URL + test.path)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		})
+	}
+}
@@ -5,17 +5,31 @@ import (
 	"errors"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/boinkor-net/tsnsrv"
 	"github.com/peterbourgon/ff/v3/ffcli"
 )
 
 func main() {
-	s, cmd, err := tsnsrv.TailnetSrvFromArgs(os.Args)
+	s, cmd, err := tsnsrv.ServicesFromArgs(os.Args)
 	if err != nil {
 		log.Fatalf("Invalid CLI usage. Errors:\n%v\n\n%v", errors.Unwrap(err), ffcli.DefaultUsageFunc(cmd))
 	}
-	if err := s.Run(context.Background()); err != nil {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := s.Reload(); err != nil {
+				log.Printf("Could not reload config, keeping the previous one: %v", err)
+			}
+		}
+	}()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = s.Run(ctx)
+	stop()
+	if err != nil {
 		log.Fatal(err)
 	}
 }
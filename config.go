@@ -0,0 +1,422 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+)
+
+// Services is a set of validated tailnet services that run in a
+// single tsnsrv process. Each service gets its own tailnet node;
+// they all share one prometheus/admin listener.
+//
+// Use ServicesFromArgs to get an instance of it.
+type Services struct {
+	Services         []*ValidTailnetSrv
+	PrometheusAddr   string
+	EnableBugReports bool
+
+	configPath string
+	// mu protects Services from being replaced by Reload while
+	// they are starting up or in use.
+	mu sync.Mutex
+}
+
+// ServicesFromArgs constructs a validated set of tailnet services
+// from commandline arguments: Either from the flags describing a
+// single service, or from the config file given in -config.
+func ServicesFromArgs(args []string) (*Services, *ffcli.Command, error) {
+	s := &TailnetSrv{}
+	var configPath string
+	fs := s.flagSet()
+	fs.StringVar(&configPath, "config", "", "Run the services listed in this config file (YAML, TOML or JSON) instead of the one given on the commandline.")
+	root := &ffcli.Command{
+		ShortUsage: fmt.Sprintf("%[1]s -name <serviceName> [flags] <toURL>\n  or:  %[1]s -config <file>", path.Base(args[0])),
+		FlagSet:    fs,
+		Exec:       func(context.Context, []string) error { return nil },
+	}
+	if err := root.Parse(args[1:]); err != nil {
+		return nil, root, fmt.Errorf("could not parse args: %w", err)
+	}
+	if configPath == "" {
+		valid, err := s.validate(root.FlagSet.Args())
+		if err != nil {
+			return nil, root, fmt.Errorf("failed to validate args: %w", err)
+		}
+		return &Services{
+			Services:         []*ValidTailnetSrv{valid},
+			PrometheusAddr:   valid.PrometheusAddr,
+			EnableBugReports: valid.EnableBugReports,
+		}, root, nil
+	}
+
+	var extra []string
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			extra = append(extra, "-"+f.Name)
+		}
+	})
+	extra = append(extra, fs.Args()...)
+	if len(extra) > 0 {
+		return nil, root, fmt.Errorf("failed to validate args: %w: %v", errConfigExclusive, extra)
+	}
+	services, err := ServicesFromConfigFile(configPath)
+	if err != nil {
+		return nil, root, fmt.Errorf("failed to validate config file: %w", err)
+	}
+	return services, root, nil
+}
+
+var errConfigExclusive = errors.New("-config can not be combined with other flags or arguments")
+var errConfigFormat = errors.New("unknown config file format, use .yaml, .yml, .toml or .json")
+var errNoServices = errors.New("config file lists no services")
+var errUnknownSetting = errors.New("unknown setting")
+var errProcessSetting = errors.New("setting applies to the whole process and can only be set at the top level")
+var errConfigStateDir = errors.New("config files need a top-level stateDir (or $TS_STATE_DIR) to keep the services' state apart")
+var errDuplicateName = errors.New("service name is used more than once")
+
+// processSettings are the config file settings that apply to the
+// whole process instead of a single service.
+var processSettings = []string{"prometheusAddr", "enableBugReports"}
+
+// ServicesFromConfigFile reads and validates a set of tailnet services
+// from a config file.
+//
+// The file's top-level keys are the default settings for every
+// service, and its "services" key holds a list of services, each
+// with settings named like tsnsrv's commandline flags, and the
+// destination URL in "toURL". A service's state is kept in a
+// subdirectory of the top-level stateDir, named after the service.
+func ServicesFromConfigFile(configPath string) (*Services, error) {
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file %#v: %w", configPath, err)
+	}
+	return servicesFromConfigContents(configPath, contents)
+}
+
+func servicesFromConfigContents(configPath string, contents []byte) (*Services, error) {
+	var config map[string]any
+	var err error
+	switch filepath.Ext(configPath) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &config)
+	case ".toml":
+		err = toml.Unmarshal(contents, &config)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(contents))
+		dec.UseNumber()
+		err = dec.Decode(&config)
+	default:
+		return nil, fmt.Errorf("%w: %#v", errConfigFormat, configPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file %#v: %w", configPath, err)
+	}
+	services, err := servicesFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	services.configPath = configPath
+	return services, nil
+}
+
+func servicesFromConfig(config map[string]any) (*Services, error) {
+	var entries []any
+	switch s := config["services"].(type) {
+	case []any:
+		entries = s
+	case []map[string]any: // TOML's arrays of tables
+		for _, entry := range s {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, errNoServices
+	}
+	defaults := map[string]any{}
+	for k, v := range config {
+		if k != "services" {
+			defaults[k] = v
+		}
+	}
+	// Process-wide settings use the same defaults as the flags:
+	process := &TailnetSrv{}
+	processFlags := quietFlagSet(process.flagSet())
+	processArgs, err := settingsArgs(processFlags, defaults, append(processSettings, "stateDir"))
+	if err != nil {
+		return nil, err
+	}
+	if err := processFlags.Parse(processArgs); err != nil {
+		return nil, fmt.Errorf("invalid top-level settings: %w", err)
+	}
+	for _, k := range processSettings {
+		delete(defaults, k)
+	}
+	baseStateDir := process.StateDir
+	delete(defaults, "stateDir")
+
+	services := &Services{
+		PrometheusAddr:   process.PrometheusAddr,
+		EnableBugReports: process.EnableBugReports,
+	}
+	var errs []error
+	for i, entry := range entries {
+		settings, ok := entry.(map[string]any)
+		if !ok {
+			errs = append(errs, fmt.Errorf("service %d: %w: expected a table of settings, got %T", i, errUnknownSetting, entry))
+			continue
+		}
+		valid, err := serviceFromConfig(defaults, settings, baseStateDir)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %d (%v): %w", i, settings["name"], err))
+			continue
+		}
+		if valid.IdentityToken && services.PrometheusAddr == "" {
+			errs = append(errs, fmt.Errorf("service %d (%v): %w", i, valid.Name, errIdentityTokenNeedsAdmin))
+			continue
+		}
+		if slices.ContainsFunc(services.Services, func(other *ValidTailnetSrv) bool { return other.Name == valid.Name }) {
+			errs = append(errs, fmt.Errorf("service %d: %w: %#v", i, errDuplicateName, valid.Name))
+			continue
+		}
+		services.Services = append(services.Services, valid)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return services, nil
+}
+
+func serviceFromConfig(defaults, settings map[string]any, baseStateDir string) (*ValidTailnetSrv, error) {
+	for _, k := range processSettings {
+		if _, ok := settings[k]; ok {
+			return nil, fmt.Errorf("%w: %v", errProcessSetting, k)
+		}
+	}
+	merged := map[string]any{}
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range settings {
+		merged[k] = v
+	}
+	var toURL []string
+	if dest, ok := merged["toURL"]; ok {
+		toURL = append(toURL, fmt.Sprint(dest))
+		delete(merged, "toURL")
+	}
+	if _, ok := merged["stateDir"]; !ok {
+		if baseStateDir == "" {
+			return nil, errConfigStateDir
+		}
+		merged["stateDir"] = filepath.Join(baseStateDir, fmt.Sprint(merged["name"]))
+	}
+
+	s := &TailnetSrv{}
+	fs := quietFlagSet(s.flagSet())
+	args, err := settingsArgs(fs, merged, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+	return s.validate(toURL)
+}
+
+// settingsArgs converts config file settings into commandline
+// arguments for the flags in fs. If only is non-empty, only those
+// settings are converted.
+func settingsArgs(fs *flag.FlagSet, settings map[string]any, only []string) ([]string, error) {
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		if len(only) > 0 && !slices.Contains(only, k) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var args []string
+	for _, k := range keys {
+		if fs.Lookup(k) == nil {
+			return nil, fmt.Errorf("%w: %#v", errUnknownSetting, k)
+		}
+		switch v := settings[k].(type) {
+		case []any:
+			for _, elt := range v {
+				args = append(args, fmt.Sprintf("-%s=%v", k, elt))
+			}
+		case map[string]any:
+			return nil, fmt.Errorf("%w: %#v must be a single value or a list, not a table", errUnknownSetting, k)
+		default:
+			args = append(args, fmt.Sprintf("-%s=%v", k, v))
+		}
+	}
+	return args, nil
+}
+
+// quietFlagSet makes fs report parse errors instead of printing usage and exiting.
+func quietFlagSet(fs *flag.FlagSet) *flag.FlagSet {
+	fs.Init(fs.Name(), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// Run connects all services to the tailnet and serves their requests
+// until one of them encounters an error, or until ctx is done. Either
+// way, it then shuts all services down gracefully.
+//
+// If the services were read from a config file, Run reloads them
+// whenever the file changes.
+func (ss *Services) Run(ctx context.Context) error {
+	ss.mu.Lock()
+	statuses := make([]*ipnstate.Status, len(ss.Services))
+	startErrs := make([]error, len(ss.Services))
+	var wg sync.WaitGroup
+	for i, s := range ss.Services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, err := s.start(ctx)
+			if err == nil {
+				err = s.activate()
+			}
+			if err != nil {
+				startErrs[i] = fmt.Errorf("starting service %v: %w", s.Name, err)
+				return
+			}
+			statuses[i] = status
+		}()
+	}
+	wg.Wait()
+	running := slices.Clone(ss.Services)
+	ss.mu.Unlock()
+	if err := errors.Join(startErrs...); err != nil {
+		for _, s := range running {
+			if s.srv != nil {
+				_ = s.srv.Close()
+			}
+		}
+		return err
+	}
+
+	admin, err := ss.setupPrometheus(running[0].srv)
+	if err != nil {
+		slog.Error("Could not setup prometheus listener", "error", err)
+	}
+	serveCtx, stopServing := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopServing()
+	if ss.configPath != "" {
+		go ss.watchConfig(serveCtx)
+	}
+	serveResults := make(chan error)
+	for i, s := range running {
+		go func() {
+			if err := s.serve(serveCtx, statuses[i]); err != nil {
+				serveResults <- fmt.Errorf("service %v: %w", s.Name, err)
+				return
+			}
+			serveResults <- nil
+		}()
+	}
+
+	var errs []error
+	select {
+	case err := <-serveResults:
+		errs = append(errs, err)
+	case <-ctx.Done():
+	}
+	// Once ctx is done or one service stopped, shut everything down,
+	// starting with the admin listener that lives on one of the nodes:
+	if admin != nil {
+		_ = admin.Close()
+	}
+	stopServing()
+	for len(errs) < len(running) {
+		errs = append(errs, <-serveResults)
+	}
+	ss.mu.Lock()
+	for _, s := range ss.Services {
+		s.transport.Close()
+	}
+	ss.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// setupPrometheus serves the admin endpoints for all services on
+// srv's tailnet node.
+func (ss *Services) setupPrometheus(srv *tsnet.Server) (*http.Server, error) {
+	if ss.PrometheusAddr == "" {
+		return nil, nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("GET /healthz", ss.healthHandler(func(ctx context.Context, s *ValidTailnetSrv) error {
+		return s.alive(ctx)
+	}))
+	mux.Handle("GET /readyz", ss.healthHandler(func(_ context.Context, s *ValidTailnetSrv) error {
+		return s.ready()
+	}))
+	mux.Handle("GET /.well-known/jwks.json", ss.jwksHandler())
+	if ss.EnableBugReports {
+		mux.HandleFunc("POST /bugreport", func(w http.ResponseWriter, r *http.Request) {
+			ss.mu.Lock()
+			services := slices.Clone(ss.Services)
+			ss.mu.Unlock()
+			var reportIDs []string
+			for _, s := range services {
+				if s.client == nil {
+					s.log().Error("failed to retrieve local tailscale client")
+					continue
+				}
+				reportID, err := s.client.BugReport(r.Context(), "")
+				if err != nil {
+					s.log().Error("failed to submit bug report logs to tailscale API", "error", err)
+					continue
+				}
+				s.log().Info("Submitted bug report logs to tailscale API", "report", reportID)
+				reportIDs = append(reportIDs, reportID)
+			}
+			_, _ = w.Write([]byte(strings.Join(reportIDs, "\n")))
+		})
+	}
+	listener, err := srv.Listen("tcp", ss.PrometheusAddr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on prometheus address %v: %w", ss.PrometheusAddr, err)
+	}
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 1 * time.Second,
+	}
+	go func() {
+		err := server.Serve(listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			return
+		}
+		slog.Error("failed to listen on prometheus address", "error", err)
+		os.Exit(20)
+	}()
+	return server, nil
+}
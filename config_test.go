@@ -0,0 +1,142 @@
+package tsnsrv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	configPath := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(configPath, []byte(contents), 0o600))
+	return configPath
+}
+
+func TestConfigFileFormats(t *testing.T) {
+	for _, elt := range []struct {
+		name, file, contents string
+	}{
+		{"yaml", "tsnsrv.yaml", `
+stateDir: /var/lib/tsnsrv
+prometheusAddr: ":9100"
+ephemeral: true
+tag: [tag:web]
+services:
+  - name: foo
+    toURL: http://127.0.0.1:8000
+    prefix: [/api, funnel:/hook]
+    funnel: true
+  - name: bar
+    toURL: http://127.0.0.1:8001
+    ephemeral: false
+    tag: [tag:other, tag:web]
+`},
+		{"toml", "tsnsrv.toml", `
+stateDir = "/var/lib/tsnsrv"
+prometheusAddr = ":9100"
+ephemeral = true
+tag = ["tag:web"]
+
+[[services]]
+name = "foo"
+toURL = "http://127.0.0.1:8000"
+prefix = ["/api", "funnel:/hook"]
+funnel = true
+
+[[services]]
+name = "bar"
+toURL = "http://127.0.0.1:8001"
+ephemeral = false
+tag = ["tag:other", "tag:web"]
+`},
+		{"json", "tsnsrv.json", `{
+  "stateDir": "/var/lib/tsnsrv",
+  "prometheusAddr": ":9100",
+  "ephemeral": true,
+  "tag": ["tag:web"],
+  "services": [
+    {"name": "foo", "toURL": "http://127.0.0.1:8000", "prefix": ["/api", "funnel:/hook"], "funnel": true},
+    {"name": "bar", "toURL": "http://127.0.0.1:8001", "ephemeral": false, "tag": ["tag:other", "tag:web"]}
+  ]
+}`},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			services, _, err := ServicesFromArgs([]string{"tsnsrv", "-config", writeConfig(t, test.file, test.contents)})
+			require.NoError(t, err)
+			assert.Equal(t, ":9100", services.PrometheusAddr)
+			assert.False(t, services.EnableBugReports)
+			require.Len(t, services.Services, 2)
+
+			foo, bar := services.Services[0], services.Services[1]
+			assert.Equal(t, "foo", foo.Name)
+			assert.Equal(t, "/var/lib/tsnsrv/foo", foo.StateDir)
+			assert.Equal(t, "http://127.0.0.1:8000", foo.DestURL.String())
+			assert.True(t, foo.Ephemeral)
+			assert.True(t, foo.Funnel)
+			assert.Equal(t, tags{"tag:web"}, foo.Tags)
+			assert.Equal(t, prefixes{{path: "/api"}, {path: "/hook", matchIf: matchFunnelOnly}}, foo.AllowedPrefixes)
+
+			assert.Equal(t, "bar", bar.Name)
+			assert.Equal(t, "/var/lib/tsnsrv/bar", bar.StateDir)
+			assert.Equal(t, "http://127.0.0.1:8001", bar.DestURL.String())
+			assert.False(t, bar.Ephemeral)
+			assert.False(t, bar.Funnel)
+			assert.Equal(t, tags{"tag:other", "tag:web"}, bar.Tags)
+		})
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for _, elt := range []struct {
+		name, contents string
+	}{
+		{"no services", `stateDir: /tmp`},
+		{"unknown setting", `
+stateDir: /tmp
+services: [{name: foo, toURL: "http://127.0.0.1", frobnicate: true}]
+`},
+		{"invalid service", `
+stateDir: /tmp
+services: [{name: foo}]
+`},
+		{"duplicate names", `
+stateDir: /tmp
+services: [{name: foo, toURL: "http://127.0.0.1"}, {name: foo, toURL: "http://127.0.0.2"}]
+`},
+		{"process setting on a service", `
+stateDir: /tmp
+services: [{name: foo, toURL: "http://127.0.0.1", prometheusAddr: ":9100"}]
+`},
+		{"invalid value", `
+stateDir: /tmp
+services: [{name: foo, toURL: "http://127.0.0.1", timeout: forever}]
+`},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := ServicesFromConfigFile(writeConfig(t, "tsnsrv.yaml", test.contents))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestConfigExclusiveWithFlags(t *testing.T) {
+	t.Parallel()
+	configPath := writeConfig(t, "tsnsrv.yaml", `
+stateDir: /tmp
+services: [{name: foo, toURL: "http://127.0.0.1"}]
+`)
+	_, _, err := ServicesFromArgs([]string{"tsnsrv", "-config", configPath})
+	require.NoError(t, err)
+	_, _, err = ServicesFromArgs([]string{"tsnsrv", "-config", configPath, "-name", "bar"})
+	require.ErrorIs(t, err, errConfigExclusive)
+	_, _, err = ServicesFromArgs([]string{"tsnsrv", "-config", configPath, "http://example.com"})
+	require.ErrorIs(t, err, errConfigExclusive)
+}
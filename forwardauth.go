@@ -0,0 +1,143 @@
+package tsnsrv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var authRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_auth_requests",
+	Help: "Number of requests checked with the -authURL, by whether it allowed or denied them (or could not be asked)",
+}, []string{"service", "decision"})
+
+type headerNames []string
+
+func (h *headerNames) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerNames) Set(value string) error {
+	for name := range strings.SplitSeq(value, ",") {
+		*h = append(*h, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+	}
+	return nil
+}
+
+var errAuthURL = errors.New("-authURL must be an http:// or https:// URL")
+
+func validateAuthURL(authURL string) error {
+	if authURL == "" {
+		return nil
+	}
+	u, err := url.Parse(authURL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%w: %#v", errAuthURL, authURL)
+	}
+	return nil
+}
+
+// hopHeaders are the headers that only apply to a single connection,
+// which don't get passed to (or from) the -authURL.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Content-Length",
+}
+
+// forwardAuth asks the service's -authURL whether to let requests
+// through, like nginx's auth_request: It sends a GET request with
+// the original request's headers, its method, URI and requestor
+// (in X-Forwarded-* headers), and their identity (in X-Tailscale-*
+// headers, like those going upstream). If the answer has a 2xx
+// status, the request goes on, with the -authResponseHeader headers
+// of the answer; otherwise, the answer goes back to the client.
+func (s *ValidTailnetSrv) forwardAuth(next http.Handler) http.Handler {
+	if s.AuthURL == "" {
+		return next
+	}
+	client := &http.Client{
+		Timeout: s.AuthTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			// Redirects (e.g. to a login page) are for the client:
+			return http.ErrUseLastResponse
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the -authURL gets to set these:
+		for _, name := range s.AuthResponseHeaders {
+			r.Header.Del(name)
+		}
+		resp, err := client.Do(s.authRequest(r))
+		if err != nil {
+			s.log().Warn("Could not check request with the auth URL",
+				"url", r.URL,
+				"error", err,
+			)
+			authRequests.With(prometheus.Labels{"service": s.Name, "decision": "error"}).Inc()
+			http.Error(w, "502 Bad Gateway: could not check authorization", http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			defer resp.Body.Close()
+			s.log().Info("Auth URL denied request",
+				"url", r.URL,
+				"http_status", resp.StatusCode,
+			)
+			authRequests.With(prometheus.Labels{"service": s.Name, "decision": "denied"}).Inc()
+			for name, values := range resp.Header {
+				w.Header()[name] = values
+			}
+			for _, name := range hopHeaders {
+				w.Header().Del(name)
+			}
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, resp.Body)
+			return
+		}
+		authRequests.With(prometheus.Labels{"service": s.Name, "decision": "allowed"}).Inc()
+		// Let the auth URL's connection go before serving the request,
+		// which may take as long as a WebSocket stays open:
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		for _, name := range s.AuthResponseHeaders {
+			if values := resp.Header.Values(name); len(values) > 0 {
+				r.Header[name] = values
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authRequest returns the request that asks the -authURL about r.
+func (s *ValidTailnetSrv) authRequest(r *http.Request) *http.Request {
+	// The URL was validated already:
+	authReq, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, s.AuthURL, nil)
+	authReq.Header = r.Header.Clone()
+	for _, name := range hopHeaders {
+		authReq.Header.Del(name)
+	}
+	proto := "https"
+	if r.TLS == nil {
+		proto = "http"
+	}
+	authReq.Header.Set("X-Forwarded-Method", r.Method)
+	authReq.Header.Set("X-Forwarded-Uri", r.RequestURI)
+	authReq.Header.Set("X-Forwarded-Host", r.Host)
+	authReq.Header.Set("X-Forwarded-Proto", proto)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		authReq.Header.Set("X-Forwarded-For", host)
+	}
+	who, _ := r.Context().Value(whoContextKey).(*apitype.WhoIsResponse)
+	setWhoisHeaders(authReq.Header, who)
+	s.setGrantHeader(authReq.Header, r)
+	return authReq
+}
@@ -0,0 +1,87 @@
+package tsnsrv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func TestForwardAuth(t *testing.T) {
+	t.Parallel()
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		login := r.Header.Get("X-Tailscale-User-LoginName")
+		uri := r.Header.Get("X-Forwarded-Uri")
+		switch {
+		case r.Header.Get("Content-Length") != "" || r.ContentLength > 0:
+			http.Error(w, "auth requests have no body", http.StatusBadRequest)
+		case strings.HasPrefix(uri, "/app/login"):
+			w.Header().Set("Location", "https://login.example.com/")
+			w.WriteHeader(http.StatusFound)
+		case login == "alice@example.com" && r.Header.Get("X-Forwarded-Method") == http.MethodPost:
+			w.Header().Set("X-Auth-User", "alice")
+			w.Header().Set("X-Auth-Secret", "not for upstream")
+		default:
+			http.Error(w, "no access for "+login+" to "+uri, http.StatusForbidden)
+		}
+	}))
+	t.Cleanup(authz.Close)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %q %q", r.URL.Path, r.Header.Get("X-Auth-User"), r.Header.Get("X-Auth-Secret"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-suppressWhois",
+		"-authURL", authz.URL + "/check",
+		"-authResponseHeader", "x-auth-user",
+		"-prefix", "/app/",
+		upstream.URL,
+	})
+	require.NoError(t, err)
+	s.whois = func(context.Context, string) (*apitype.WhoIsResponse, error) {
+		return whoIs("alice@example.com", "laptop"), nil
+	}
+	proxy := httptest.NewServer(s.mux(http.DefaultTransport, false))
+	t.Cleanup(proxy.Close)
+	client := proxy.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	request := func(method, path string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(t.Context(), method, proxy.URL+path, strings.NewReader("payload"))
+		require.NoError(t, err)
+		req.Header.Set("X-Auth-User", "mallory")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := request(http.MethodPost, "/app/items")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `/items "alice" ""`, body, "only -authResponseHeader headers go upstream")
+
+	resp, body = request(http.MethodGet, "/app/items")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "no access for alice@example.com to /app/items\n", body, "the auth URL sees the original URI and identity")
+
+	resp, _ = request(http.MethodGet, "/app/login")
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "redirects go back to the client")
+	assert.Equal(t, "https://login.example.com/", resp.Header.Get("Location"))
+
+	authz.Close()
+	resp, _ = request(http.MethodPost, "/app/items")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	_, _, err = TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-authURL", "127.0.0.1:8181", "http://example.com"})
+	require.ErrorIs(t, err, errAuthURL)
+}
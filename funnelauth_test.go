@@ -0,0 +1,298 @@
+package tsnsrv
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// whoisUpstream returns an upstream server that answers with the
+// identity headers that it got.
+func whoisUpstream(t *testing.T) string {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %q %q %q %q", r.URL.Path,
+			r.Header.Get("X-Tailscale-User-LoginName"),
+			r.Header.Get("X-Tailscale-User-DisplayName"),
+			r.Header.Get("X-Tailscale-Node-Name"),
+			r.Header.Get("X-Tailscale-Funnel-User"))
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestFunnelAuthFile(t *testing.T) {
+	t.Parallel()
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	authFile := func(contents string) string {
+		path := filepath.Join(dir, fmt.Sprintf("auth-%d", len(contents)))
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+		return path
+	}
+
+	for _, elt := range []struct {
+		name, contents string
+	}{
+		{"missing secret", "alice basic\n"},
+		{"unknown kind", "alice digest abc\n"},
+		{"plain password", "alice basic hunter2\n"},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-funnelAuthFile", authFile(test.contents), "http://example.com"})
+			require.NoError(t, err)
+			require.ErrorIs(t, s.loadFunnelAuth(), errFunnelAuthFileFormat)
+		})
+	}
+
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(),
+		"-funnelAuthFile", authFile("# static users\nalice basic " + string(hash) + "\n\nci-bot bearer t0ken\n"),
+		"-webhook", "/hook=gitlab:" + authFile("s3cret"),
+		whoisUpstream(t),
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.loadFunnelAuth())
+	require.NoError(t, s.loadWebhookSecrets())
+	funnel := httptest.NewServer(s.mux(http.DefaultTransport, true))
+	t.Cleanup(funnel.Close)
+	tailnet := httptest.NewServer(s.mux(http.DefaultTransport, false))
+	t.Cleanup(tailnet.Close)
+
+	for _, elt := range []struct {
+		name     string
+		proxy    *httptest.Server
+		auth     func(*http.Request)
+		status   int
+		expected string
+	}{
+		{"no credentials", funnel, func(*http.Request) {}, http.StatusUnauthorized, ""},
+		{"wrong password", funnel, func(r *http.Request) { r.SetBasicAuth("alice", "hunter3") }, http.StatusUnauthorized, ""},
+		{"unknown user", funnel, func(r *http.Request) { r.SetBasicAuth("bob", "hunter2") }, http.StatusUnauthorized, ""},
+		{"wrong token", funnel, func(r *http.Request) { r.Header.Set("Authorization", "Bearer t1ken") }, http.StatusUnauthorized, ""},
+		{"basic", funnel, func(r *http.Request) { r.SetBasicAuth("alice", "hunter2") }, http.StatusOK, `/ "funnel:alice" "alice" "" "1"`},
+		{"bearer", funnel, func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0ken") }, http.StatusOK, `/ "funnel:ci-bot" "ci-bot" "" "1"`},
+		{"tailnet", tailnet, func(*http.Request) {}, http.StatusOK, `/ "" "" "" ""`},
+		{"webhook", funnel, func(r *http.Request) { r.URL.Path = "/hook"; r.Header.Set("X-Gitlab-Token", "s3cret") }, http.StatusOK, `/hook "" "" "" ""`},
+		{"next to webhook", funnel, func(r *http.Request) { r.URL.Path = "/hooks"; r.Header.Set("X-Gitlab-Token", "s3cret") }, http.StatusUnauthorized, ""},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, test.proxy.URL, nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Tailscale-User-LoginName", "mallory")
+			req.Header.Set("X-Tailscale-Funnel-User", "0")
+			test.auth(req)
+			resp, err := test.proxy.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, test.status, resp.StatusCode, string(body))
+			if test.status == http.StatusOK {
+				assert.Equal(t, test.expected, string(body))
+			} else {
+				assert.Equal(t, []string{`Basic realm="TestFunnelAuthFile"`, `Bearer realm="TestFunnelAuthFile"`}, resp.Header.Values("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+// fakeIssuer is an OIDC issuer that hands out ID tokens for codes
+// that tests register.
+type fakeIssuer struct {
+	*httptest.Server
+	clientID string
+	mu       sync.Mutex
+	logins   map[string]fakeLogin // by code
+}
+
+type fakeLogin struct {
+	params        url.Values // of the authorization request
+	emailVerified bool
+}
+
+func newFakeIssuer(t *testing.T, clientID string) *fakeIssuer {
+	t.Helper()
+	issuer := &fakeIssuer{clientID: clientID, logins: map[string]fakeLogin{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		login, ok := issuer.logins[r.PostFormValue("code")]
+		issuer.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != login.params.Get("code_challenge") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims, _ := json.Marshal(map[string]any{
+			"iss":            issuer.URL,
+			"aud":            []string{login.params.Get("client_id")},
+			"sub":            "1234",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          login.params.Get("nonce"),
+			"email":          "bob@example.com",
+			"email_verified": login.emailVerified,
+			"name":           "Bob",
+		})
+		idToken := "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".c2ln"
+		writeJSON(w, http.StatusOK, map[string]any{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// login pretends that a user logged in after being sent to
+// authorizeURL, and returns the code that the issuer hands them.
+func (i *fakeIssuer) login(t *testing.T, authorizeURL string, emailVerified bool) string {
+	t.Helper()
+	u, err := url.Parse(authorizeURL)
+	require.NoError(t, err)
+	require.Equal(t, i.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(t, i.clientID, u.Query().Get("client_id"))
+	assert.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	code := fmt.Sprintf("code-%d", len(i.logins))
+	i.logins[code] = fakeLogin{u.Query(), emailVerified}
+	return code
+}
+
+func TestFunnelOIDCLogin(t *testing.T) {
+	t.Parallel()
+	issuer := newFakeIssuer(t, "tsnsrv")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("s3cret\n"), 0o600))
+
+	_, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-funnelOIDCIssuer", issuer.URL, "http://example.com"})
+	require.ErrorIs(t, err, errFunnelOIDCSettings)
+
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-stateDir", t.TempDir(),
+		"-funnelOIDCIssuer", issuer.URL,
+		"-funnelOIDCClientID", "tsnsrv",
+		"-funnelOIDCClientSecretFile", secretFile,
+		whoisUpstream(t),
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.loadFunnelAuth())
+	proxy := httptest.NewServer(s.mux(http.DefaultTransport, true))
+	t.Cleanup(proxy.Close)
+	client := proxy.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	get := func(path string, cookies ...*http.Cookie) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, proxy.URL+path, nil)
+		require.NoError(t, err)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+	cookie := func(resp *http.Response, name string) *http.Cookie {
+		t.Helper()
+		for _, c := range resp.Cookies() {
+			if c.Name == name {
+				assert.True(t, c.Secure)
+				assert.True(t, c.HttpOnly)
+				return c
+			}
+		}
+		require.Failf(t, "no cookie", "%v in %v", name, resp.Header)
+		return nil
+	}
+
+	resp, _ := get("/docs/page?x=1")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	loginCookie := cookie(resp, funnelLoginCookie)
+	code := issuer.login(t, resp.Header.Get("Location"), true)
+	redirect, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	state := redirect.Query().Get("state")
+	assert.Equal(t, "https://"+proxy.Listener.Addr().String()+funnelCallbackPath, redirect.Query().Get("redirect_uri"))
+
+	resp, _ = get(funnelCallbackPath+"?code="+code+"&state=wrong", loginCookie)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "state must match")
+	resp, _ = get(funnelCallbackPath + "?code=" + code + "&state=" + state)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "login cookie is required")
+	forged := *loginCookie
+	forged.Value = strings.Replace(forged.Value, ".", ".x", 1)
+	resp, _ = get(funnelCallbackPath+"?code="+code+"&state="+state, &forged)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "login cookie must be signed")
+
+	resp, _ = get(funnelCallbackPath+"?code="+code+"&state="+state, loginCookie)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/docs/page?x=1", resp.Header.Get("Location"))
+	session := cookie(resp, funnelSessionCookie)
+
+	resp, body := get("/docs/page", session)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `/docs/page "funnel:bob@example.com" "Bob" "" "1"`, body)
+
+	forged = *session
+	forged.Value = strings.Replace(forged.Value, ".", ".x", 1)
+	resp, _ = get("/docs/page", &forged)
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "forged sessions have to log in again")
+
+	// Unverified email addresses don't count as logins:
+	resp, _ = get("/")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	loginCookie = cookie(resp, funnelLoginCookie)
+	code = issuer.login(t, resp.Header.Get("Location"), false)
+	redirect, err = url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	resp, _ = get(funnelCallbackPath+"?code="+code+"&state="+redirect.Query().Get("state"), loginCookie)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	resp, body = get("/", cookie(resp, funnelSessionCookie))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `/ "funnel:`+issuer.URL+`#1234" "Bob" "" "1"`, body)
+}
+
+func TestFunnelUserHeaders(t *testing.T) {
+	t.Parallel()
+	tailnet := http.Header{"X-Tailscale-Funnel-User": {"1"}}
+	setWhoisHeaders(tailnet, whoIs("alice@example.com", "laptop"))
+	funnel := http.Header{}
+	setWhoisHeaders(funnel, funnelUser("alice@example.com", "alice"))
+
+	assert.Empty(t, tailnet.Get("X-Tailscale-Funnel-User"), "incoming copies are stripped")
+	assert.Equal(t, "1", funnel.Get("X-Tailscale-Funnel-User"))
+	assert.Equal(t, "alice@example.com", tailnet.Get("X-Tailscale-User-LoginName"))
+	assert.Equal(t, "funnel:alice@example.com", funnel.Get("X-Tailscale-User-LoginName"))
+	for name := range funnel {
+		if name != "X-Tailscale-Funnel-User" && name != "X-Tailscale-User-DisplayName" {
+			assert.NotEqual(t, tailnet.Get(name), funnel.Get(name), name)
+		}
+	}
+}
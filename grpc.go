@@ -0,0 +1,56 @@
+package tsnsrv
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var grpcStatuses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_grpc_responses",
+	Help: "gRPC responses by grpc-status code (0 is OK; 'unknown' if the response ended without one)",
+}, []string{"service", "grpc_status"})
+
+// isGRPC returns whether res answers a gRPC call.
+func isGRPC(res *http.Response) bool {
+	return strings.HasPrefix(res.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcStatus returns the status code of a gRPC response whose body
+// has been read: it's in the trailers, or (for responses without a
+// body) in the headers.
+func grpcStatus(res *http.Response) string {
+	if status := res.Trailer.Get("Grpc-Status"); status != "" {
+		return status
+	}
+	if status := res.Header.Get("Grpc-Status"); status != "" {
+		return status
+	}
+	return "unknown"
+}
+
+// grpcBody calls done once the body of a gRPC response (and with it,
+// the trailers holding its status) has been read, or closed early.
+type grpcBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *grpcBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.done)
+	}
+	return n, err //nolint:wrapcheck // the reverse proxy expects io.EOF as is
+}
+
+func (b *grpcBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err //nolint:wrapcheck // passed through like the body's own errors
+}
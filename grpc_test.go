@@ -0,0 +1,98 @@
+package tsnsrv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// grpcUpstream returns an upstream server that answers like a gRPC
+// service would, with the given grpc-status in its trailers. Its
+// responses' bodies hold the protocol that the request came in with.
+func grpcUpstream(t *testing.T, status string) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = io.WriteString(w, r.Proto)
+		// Like gRPC servers, stream the response without a Content-Length:
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", status)
+	}))
+	ts.Config.Protocols = &http.Protocols{}
+	ts.Config.Protocols.SetHTTP1(true)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestUpstreamProtocols(t *testing.T) {
+	t.Parallel()
+	h2c := grpcUpstream(t, "0")
+	h2c.Start()
+	h2 := grpcUpstream(t, "5")
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+
+	for _, elt := range []struct {
+		name, protocol, url, proto, status string
+	}{
+		{"http1", "http1", h2c.URL, "HTTP/1.1", "0"},
+		{"h2c", "h2c", h2c.URL, "HTTP/2.0", "0"},
+		{"h2", "h2", h2.URL, "HTTP/2.0", "5"},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-suppressTailnetDialer", "-insecureHTTPS",
+				"-upstreamProtocol", test.protocol, test.url})
+			require.NoError(t, err)
+			transport := s.newTransport()
+			t.Cleanup(transport.Close)
+			proxy := httptest.NewServer(s.mux(transport, false))
+			t.Cleanup(proxy.Close)
+
+			resp, err := proxy.Client().Post(proxy.URL+"/helloworld.Greeter/SayHello", "application/grpc", nil)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.proto, string(body))
+			assert.Equal(t, test.status, resp.Trailer.Get("Grpc-Status"), "trailers make it through")
+		})
+	}
+}
+
+func TestUpstreamProtocolScheme(t *testing.T) {
+	t.Parallel()
+	_, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-upstreamProtocol", "h2", "http://127.0.0.1:50051"})
+	require.ErrorIs(t, err, errUpstreamProtocolScheme)
+	_, _, err = TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-upstreamProtocol", "h2c", "https://127.0.0.1:50051"})
+	require.ErrorIs(t, err, errUpstreamProtocolScheme)
+
+	var protocol upstreamProtocol
+	assert.ErrorIs(t, protocol.Set("h3"), errUpstreamProtocol)
+}
+
+func TestGRPCStatus(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		name            string
+		header, trailer http.Header
+		status          string
+	}{
+		{"in trailers", http.Header{}, http.Header{"Grpc-Status": {"14"}}, "14"},
+		{"trailers-only response", http.Header{"Grpc-Status": {"7"}}, nil, "7"},
+		{"missing", http.Header{}, nil, "unknown"},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, test.status, grpcStatus(&http.Response{Header: test.header, Trailer: test.trailer}))
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package tsnsrv
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	grpcContentType        = "application/grpc"
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	// grpcTrailerFlag marks the gRPC-Web frame that holds the trailers.
+	grpcTrailerFlag = 0x80
+)
+
+var errGRPCWebNeedsHTTP2 = errors.New("grpcweb: prefixes need an HTTP/2 -upstreamProtocol (h2c or h2) to make gRPC calls with")
+
+// translatesGRPCWeb returns whether any of the service's prefixes
+// (or its listeners' prefixes) have the grpcweb: qualifier.
+func (s *TailnetSrv) translatesGRPCWeb() bool {
+	isGRPCWeb := func(p prefix) bool { return p.grpcWeb }
+	return slices.ContainsFunc(s.AllowedPrefixes, isGRPCWeb) ||
+		slices.ContainsFunc(s.Listeners, func(l listener) bool { return slices.ContainsFunc(l.prefixes, isGRPCWeb) })
+}
+
+// grpcWeb translates gRPC-Web requests on the prefixes that have the
+// grpcweb: qualifier into native gRPC ones for handler, and handler's
+// gRPC responses back into gRPC-Web, with the trailers in the body.
+// Bodies of grpc-web-text requests and responses are base64-encoded.
+func grpcWeb(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := r.Context().Value(routeContextKey).(*prefix)
+		contentType := r.Header.Get("Content-Type")
+		if route == nil || !route.grpcWeb || !strings.HasPrefix(contentType, grpcWebContentType) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		webContentType := grpcWebContentType
+		text := strings.HasPrefix(contentType, grpcWebTextContentType)
+		if text {
+			webContentType = grpcWebTextContentType
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.Header.Set("Content-Type", grpcContentType+strings.TrimPrefix(contentType, webContentType))
+		r2.Header.Set("Te", "trailers")
+		if text {
+			r2.Body = io.NopCloser(base64.NewDecoder(base64.StdEncoding, r.Body))
+			r2.ContentLength = -1
+			r2.Header.Del("Content-Length")
+		}
+		gw := &grpcWebWriter{w: w, header: http.Header{}, webContentType: webContentType}
+		handler.ServeHTTP(gw, r2)
+		gw.finish()
+	})
+}
+
+// grpcWebWriter turns the gRPC response written to it into a
+// gRPC-Web response on w.
+type grpcWebWriter struct {
+	w              http.ResponseWriter
+	header         http.Header
+	webContentType string
+
+	wroteHeader bool
+	translate   bool           // whether the response is a gRPC one
+	body        io.Writer      // w, or an encoder writing to it
+	encoder     io.WriteCloser // for grpc-web-text responses
+}
+
+func (gw *grpcWebWriter) Header() http.Header {
+	return gw.header
+}
+
+func (gw *grpcWebWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	contentType := gw.header.Get("Content-Type")
+	gw.translate = strings.HasPrefix(contentType, grpcContentType)
+	for name, values := range gw.header {
+		if gw.translate && (name == "Trailer" || name == "Content-Length" || strings.HasPrefix(name, http.TrailerPrefix)) {
+			continue
+		}
+		gw.w.Header()[name] = values
+	}
+	gw.body = gw.w
+	if gw.translate {
+		gw.w.Header().Set("Content-Type", gw.webContentType+strings.TrimPrefix(contentType, grpcContentType))
+		if gw.webContentType == grpcWebTextContentType {
+			gw.encoder = base64.NewEncoder(base64.StdEncoding, gw.w)
+			gw.body = gw.encoder
+		}
+	}
+	gw.w.WriteHeader(code)
+}
+
+func (gw *grpcWebWriter) Write(b []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	return gw.body.Write(b) //nolint:wrapcheck // passed through like the response writer's own errors
+}
+
+// Flush sends what was written so far to the client. Base64-encoded
+// bodies get padded there, which gRPC-Web clients expect.
+func (gw *grpcWebWriter) Flush() {
+	if gw.encoder != nil {
+		gw.encoder.Close()
+		gw.encoder = base64.NewEncoder(base64.StdEncoding, gw.w)
+		gw.body = gw.encoder
+	}
+	_ = http.NewResponseController(gw.w).Flush()
+}
+
+// finish writes the trailers into the body, in a frame of their own.
+func (gw *grpcWebWriter) finish() {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if !gw.translate {
+		return
+	}
+	trailers := http.Header{}
+	for _, declared := range gw.header.Values("Trailer") {
+		for name := range strings.SplitSeq(declared, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			trailers[name] = gw.header[name]
+		}
+	}
+	for name, values := range gw.header {
+		if name, ok := strings.CutPrefix(name, http.TrailerPrefix); ok {
+			trailers[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	var block strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(trailers)) {
+		for _, value := range trailers[name] {
+			block.WriteString(strings.ToLower(name) + ": " + value + "\r\n")
+		}
+	}
+	if block.Len() > 0 {
+		frame := make([]byte, 5, 5+block.Len())
+		frame[0] = grpcTrailerFlag
+		binary.BigEndian.PutUint32(frame[1:], uint32(block.Len())) //nolint:gosec // trailers are much smaller than 4GB
+		_, _ = gw.body.Write(append(frame, block.String()...))
+	}
+	if gw.encoder != nil {
+		gw.encoder.Close()
+	}
+}
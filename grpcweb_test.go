@@ -0,0 +1,98 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// grpcFrame returns a gRPC message frame with the given flags and payload.
+func grpcFrame(flags byte, payload string) []byte {
+	frame := []byte{flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// decodeGRPCWebText decodes a grpc-web-text body, whose base64
+// chunks may each be padded.
+func decodeGRPCWebText(t *testing.T, body []byte) []byte {
+	t.Helper()
+	require.Zero(t, len(body)%4, "base64 chunks are padded")
+	var decoded []byte
+	for i := 0; i < len(body); i += 4 {
+		quantum, err := base64.StdEncoding.DecodeString(string(body[i : i+4]))
+		require.NoError(t, err)
+		decoded = append(decoded, quantum...)
+	}
+	return decoded
+}
+
+func TestGRPCWeb(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Echo the request's message back, like a gRPC service would:
+		message, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+		_, _ = w.Write(message)
+		w.(http.Flusher).Flush()
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", r.Proto+" "+r.Header.Get("Te"))
+	}))
+	upstream.Config.Protocols = &http.Protocols{}
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-suppressTailnetDialer",
+		"-upstreamProtocol", "h2c",
+		"-prefix", "grpcweb:/api",
+		"-prefix", "/other",
+		upstream.URL,
+	})
+	require.NoError(t, err)
+	transport := s.newTransport()
+	t.Cleanup(transport.Close)
+	proxy := httptest.NewServer(s.mux(transport, false))
+	t.Cleanup(proxy.Close)
+
+	_, _, err = TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-prefix", "grpcweb:/api", upstream.URL})
+	require.ErrorIs(t, err, errGRPCWebNeedsHTTP2)
+	_, _, err = TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-listen", ":8443,tls,prefix=grpcweb:/api", upstream.URL})
+	require.ErrorIs(t, err, errGRPCWebNeedsHTTP2)
+
+	message := grpcFrame(0, "hello")
+	trailers := grpcFrame(grpcTrailerFlag, "grpc-message: HTTP/2.0 trailers\r\ngrpc-status: 0\r\n")
+	for _, elt := range []struct {
+		name, path, contentType string
+		body                    []byte
+		expectedType            string
+		expected                []byte
+	}{
+		{"binary", "/api/echo.Echo/Echo", "application/grpc-web+proto", message, "application/grpc-web+proto", append(message, trailers...)},
+		{"text", "/api/echo.Echo/Echo", "application/grpc-web-text", []byte(base64.StdEncoding.EncodeToString(message)), "application/grpc-web-text", append(message, trailers...)},
+		{"prefix without grpcweb:", "/other/echo.Echo/Echo", "application/grpc-web+proto", message, "application/grpc-web+proto", message},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			resp, err := proxy.Client().Post(proxy.URL+test.path, test.contentType, bytes.NewReader(test.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, test.expectedType, resp.Header.Get("Content-Type"))
+			if test.expectedType == grpcWebTextContentType {
+				body = decodeGRPCWebText(t, body)
+			}
+			assert.Equal(t, test.expected, body)
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package tsnsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tsnsrv_upstream_healthy",
+	Help: "Whether the health checks against an upstream address pass (1) or fail (0)",
+}, []string{"service", "upstream"})
+
+type healthCheckKind int
+
+const (
+	healthCheckNone healthCheckKind = iota
+	healthCheckHTTP
+	healthCheckConnect
+)
+
+// healthCheck describes how to probe each of a service's upstream
+// addresses.
+type healthCheck struct {
+	kind healthCheckKind
+	path string
+}
+
+func (c *healthCheck) String() string {
+	switch c.kind {
+	case healthCheckHTTP:
+		return "http:" + c.path
+	case healthCheckConnect:
+		return "connect"
+	case healthCheckNone:
+	}
+	return ""
+}
+
+var errHealthCheckFormat = errors.New("health checks must look like 'http:<path>' or 'connect'")
+var errHealthCheckSettings = errors.New("health checks need a positive -healthCheckInterval and -healthCheckThreshold")
+
+func (c *healthCheck) Set(value string) error {
+	switch {
+	case value == "":
+		*c = healthCheck{}
+	case value == "connect":
+		*c = healthCheck{kind: healthCheckConnect}
+	case strings.HasPrefix(value, "http:/"):
+		*c = healthCheck{kind: healthCheckHTTP, path: strings.TrimPrefix(value, "http:")}
+	default:
+		return fmt.Errorf("%w: %#v", errHealthCheckFormat, value)
+	}
+	return nil
+}
+
+// statusCodes is a list of HTTP status codes, where codes like "2xx"
+// stand for a whole class of them.
+type statusCodes []string
+
+func (sc *statusCodes) String() string {
+	return strings.Join(*sc, ",")
+}
+
+var errStatusCodeFormat = errors.New("status codes must be numbers like 200, or classes like 2xx")
+
+func (sc *statusCodes) Set(value string) error {
+	var codes statusCodes
+	for code := range strings.SplitSeq(value, ",") {
+		code = strings.TrimSpace(code)
+		digits := strings.TrimSuffix(code, "xx")
+		if n, err := strconv.Atoi(digits); err != nil || len(code) != 3 || n < 1 || n > 599 {
+			return fmt.Errorf("%w: %#v", errStatusCodeFormat, code)
+		}
+		codes = append(codes, code)
+	}
+	*sc = codes
+	return nil
+}
+
+func (sc statusCodes) matches(status int) bool {
+	return slices.ContainsFunc(sc, func(code string) bool {
+		if class, ok := strings.CutSuffix(code, "xx"); ok {
+			return class == strconv.Itoa(status/100)
+		}
+		return code == strconv.Itoa(status)
+	})
+}
+
+// checkHealth probes the pool's addresses as the service's
+// -healthCheck describes, until the pool gets closed. Addresses count
+// as unhealthy once -healthCheckThreshold probes in a row failed, and
+// as healthy again once as many succeeded.
+func (p *upstreamPool) checkHealth(s *ValidTailnetSrv) {
+	if s.HealthCheck.kind == healthCheckNone {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stopChecks = cancel
+	for _, e := range p.endpoints {
+		upstreamHealthy.With(prometheus.Labels{"service": p.service, "upstream": e.name}).Set(1)
+		go func() {
+			streak := 0
+			ticker := time.NewTicker(s.HealthCheckInterval)
+			defer ticker.Stop()
+			for {
+				err := s.probe(ctx, e)
+				if ctx.Err() != nil {
+					return
+				}
+				if healthy := err == nil; healthy == e.healthy.Load() {
+					streak = 0
+				} else if streak++; streak >= s.HealthCheckThreshold {
+					streak = 0
+					e.healthy.Store(healthy)
+					p.reportHealth(e, err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+}
+
+func (p *upstreamPool) reportHealth(e *upstreamEndpoint, err error) {
+	gauge := upstreamHealthy.With(prometheus.Labels{"service": p.service, "upstream": e.name})
+	if err != nil {
+		gauge.Set(0)
+		serviceLog(p.service).Warn("Upstream failed its health checks", "upstream", e.name, "error", err)
+		return
+	}
+	gauge.Set(1)
+	serviceLog(p.service).Info("Upstream passed its health checks again", "upstream", e.name)
+}
+
+var errUnexpectedStatus = errors.New("unexpected status")
+
+// probe runs one health check against e.
+func (s *ValidTailnetSrv) probe(ctx context.Context, e *upstreamEndpoint) error {
+	ctx, cancel := context.WithTimeout(ctx, s.HealthCheckInterval)
+	defer cancel()
+	switch s.HealthCheck.kind {
+	case healthCheckConnect:
+		conn, err := e.dial(ctx, "tcp", s.destAddr())
+		if err != nil {
+			return err
+		}
+		return conn.Close() //nolint:wrapcheck // Closing the probe connection is all that's left to do.
+	case healthCheckHTTP:
+		url := *s.DestURL
+		url.Path, url.RawPath, url.RawQuery = "", "", ""
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.String()+s.HealthCheck.path, nil)
+		if err != nil {
+			return fmt.Errorf("building health check request: %w", err)
+		}
+		req.Header.Set("User-Agent", "tsnsrv health check")
+		res, err := e.transport.RoundTrip(req)
+		if err != nil {
+			return fmt.Errorf("health check request: %w", err)
+		}
+		res.Body.Close()
+		if !s.HealthCheckStatus.matches(res.StatusCode) {
+			return fmt.Errorf("%w %d, expected %v", errUnexpectedStatus, res.StatusCode, s.HealthCheckStatus.String())
+		}
+	case healthCheckNone:
+	}
+	return nil
+}
+
+var errNoHealthyUpstream = errors.New("no upstream address passes its health checks")
+
+// ready returns an error if the service can't pass requests on to
+// any of its upstream addresses.
+func (s *ValidTailnetSrv) ready() error {
+	if s.transport == nil {
+		return errNotRunning
+	}
+	if slices.ContainsFunc(s.transport.endpoints, func(e *upstreamEndpoint) bool { return e.healthy.Load() }) {
+		return nil
+	}
+	return errNoHealthyUpstream
+}
+
+var errNodeNotRunning = errors.New("tailnet node is not running")
+
+// alive returns an error if the service's node is not connected to the tailnet.
+func (s *ValidTailnetSrv) alive(ctx context.Context) error {
+	if s.client == nil {
+		return nil
+	}
+	status, err := s.client.StatusWithoutPeers(ctx)
+	if err != nil {
+		return fmt.Errorf("getting node status: %w", err)
+	}
+	if status.BackendState != "Running" {
+		return fmt.Errorf("%w: %v", errNodeNotRunning, status.BackendState)
+	}
+	return nil
+}
+
+// healthHandler reports the result of check for each of the
+// services, failing with a 503 status if any of them fails.
+func (ss *Services) healthHandler(check func(context.Context, *ValidTailnetSrv) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ss.mu.Lock()
+		services := slices.Clone(ss.Services)
+		ss.mu.Unlock()
+		status := http.StatusOK
+		var report []string
+		for _, s := range services {
+			if err := check(r.Context(), s); err != nil {
+				status = http.StatusServiceUnavailable
+				report = append(report, fmt.Sprintf("%v: %v", s.Name, err))
+				continue
+			}
+			report = append(report, s.Name+": ok")
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(strings.Join(report, "\n") + "\n"))
+	})
+}
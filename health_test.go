@@ -0,0 +1,111 @@
+package tsnsrv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckFormat(t *testing.T) {
+	t.Parallel()
+	var check healthCheck
+	require.NoError(t, check.Set("http:/healthz"))
+	assert.Equal(t, healthCheck{kind: healthCheckHTTP, path: "/healthz"}, check)
+	require.NoError(t, check.Set("connect"))
+	assert.Equal(t, "connect", check.String())
+	assert.ErrorIs(t, check.Set("http:healthz"), errHealthCheckFormat)
+	assert.ErrorIs(t, check.Set("udp"), errHealthCheckFormat)
+
+	var codes statusCodes
+	require.NoError(t, codes.Set("200, 3xx"))
+	assert.True(t, codes.matches(200))
+	assert.True(t, codes.matches(302))
+	assert.False(t, codes.matches(204))
+	assert.ErrorIs(t, codes.Set("2x"), errStatusCodeFormat)
+	assert.ErrorIs(t, codes.Set("600"), errStatusCodeFormat)
+}
+
+// flakyUpstream returns the address of an upstream whose health
+// endpoint fails while failing is set.
+func flakyUpstream(t *testing.T, name string, failing *atomic.Bool) string {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(name))
+	}))
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+func TestHealthChecks(t *testing.T) {
+	t.Parallel()
+	var aFailing, bFailing atomic.Bool
+	s := poolService(t, []string{"-healthCheck", "http:/health", "-healthCheckInterval", "10ms", "-healthCheckThreshold", "2"},
+		flakyUpstream(t, "a", &aFailing), flakyUpstream(t, "b", &bFailing))
+	require.NoError(t, s.activate())
+	t.Cleanup(s.transport.Close)
+	services := &Services{Services: []*ValidTailnetSrv{s}}
+	readyz := httptest.NewServer(services.healthHandler(func(_ context.Context, s *ValidTailnetSrv) error { return s.ready() }))
+	t.Cleanup(readyz.Close)
+	proxy := httptest.NewServer(s.handlers[0])
+	t.Cleanup(proxy.Close)
+
+	status, _ := getBody(t, readyz.Client(), readyz.URL)
+	assert.Equal(t, http.StatusOK, status)
+
+	// Unhealthy addresses get skipped:
+	aFailing.Store(true)
+	a := s.transport.endpoints[0]
+	require.Eventually(t, func() bool { return !a.healthy.Load() }, 5*time.Second, 10*time.Millisecond)
+	for range 3 {
+		_, body := getBody(t, proxy.Client(), proxy.URL)
+		assert.Equal(t, "b", body)
+	}
+	status, _ = getBody(t, readyz.Client(), readyz.URL)
+	assert.Equal(t, http.StatusOK, status)
+
+	// Without any healthy addresses, the service is unavailable:
+	bFailing.Store(true)
+	b := s.transport.endpoints[1]
+	require.Eventually(t, func() bool { return !b.healthy.Load() }, 5*time.Second, 10*time.Millisecond)
+	status, body := getBody(t, proxy.Client(), proxy.URL)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Contains(t, body, "is down right now")
+	status, body = getBody(t, readyz.Client(), readyz.URL)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Contains(t, body, errNoHealthyUpstream.Error())
+
+	// ...until they recover:
+	aFailing.Store(false)
+	require.Eventually(t, func() bool { return a.healthy.Load() }, 5*time.Second, 10*time.Millisecond)
+	_, body = getBody(t, proxy.Client(), proxy.URL)
+	assert.Equal(t, "a", body)
+}
+
+func TestConnectHealthCheck(t *testing.T) {
+	t.Parallel()
+	s := poolService(t, []string{"-healthCheck", "connect", "-healthCheckInterval", "10ms", "-healthCheckThreshold", "1"},
+		deadUpstream(t), namedUpstream(t, "alive"))
+	require.NoError(t, s.activate())
+	t.Cleanup(s.transport.Close)
+
+	dead, alive := s.transport.endpoints[0], s.transport.endpoints[1]
+	require.Eventually(t, func() bool { return !dead.healthy.Load() }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, alive.healthy.Load())
+	assert.NoError(t, s.ready())
+}
+
+func TestHealthCheckSettings(t *testing.T) {
+	t.Parallel()
+	_, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-healthCheck", "connect", "-healthCheckThreshold", "0", "http://example.com"})
+	require.ErrorIs(t, err, errHealthCheckSettings)
+}
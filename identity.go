@@ -0,0 +1,235 @@
+package tsnsrv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// identityKeyFile is the file in the -stateDir that holds the key
+// that signs identity tokens.
+const identityKeyFile = "tsnsrv-identity-key.pem"
+
+// identityJWKSFile is the file in the -stateDir that holds the public
+// key that verifies identity tokens, for upstream services that can't
+// reach the admin listener.
+const identityJWKSFile = "tsnsrv-identity-jwks.json"
+
+var errIdentityKeyType = errors.New("identity key must be an ECDSA P-256 key")
+var errIdentityTokenNeedsAdmin = errors.New("-identityToken needs a -prometheusAddr to serve the keys that verify its tokens")
+
+// identityKey signs the identity tokens that a service passes
+// upstream, as ES256 JWTs.
+type identityKey struct {
+	key *ecdsa.PrivateKey
+	kid string // the key's JWK thumbprint (RFC 7638)
+}
+
+// signsTokens returns whether the service signs identity tokens, or
+// the ID tokens of its OIDC provider.
+func (s *TailnetSrv) signsTokens() bool {
+	return s.IdentityToken || s.OIDCPrefix != ""
+}
+
+// loadIdentityKey loads the key that signs the service's identity
+// tokens from its -stateDir, generating it on first use, if it signs
+// tokens and the key isn't loaded yet. Without a -stateDir, the key
+// only lasts until tsnsrv exits.
+func (s *ValidTailnetSrv) loadIdentityKey() error {
+	if !s.signsTokens() || s.identityKey != nil {
+		return nil
+	}
+	if s.StateDir == "" {
+		s.log().Warn("No -stateDir to keep the identity token key in; it will change when tsnsrv restarts")
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("generating identity key: %w", err)
+		}
+		s.identityKey = newIdentityKey(key)
+		return nil
+	}
+	key, err := readIdentityKey(filepath.Join(s.StateDir, identityKeyFile))
+	if err != nil {
+		return err
+	}
+	s.identityKey = newIdentityKey(key)
+	jwks, err := json.Marshal(map[string]any{"keys": []map[string]string{s.identityKey.jwk()}})
+	if err != nil {
+		return fmt.Errorf("encoding identity JWKS: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(s.StateDir, identityJWKSFile), jwks, 0o644); err != nil { // #nosec It only holds the public key
+		return fmt.Errorf("storing identity JWKS: %w", err)
+	}
+	return nil
+}
+
+// readIdentityKey reads the PEM-encoded key at path, or generates and
+// stores one there if there is none.
+func readIdentityKey(path string) (*ecdsa.PrivateKey, error) {
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generating identity key: %w", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("encoding identity key: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, fmt.Errorf("creating directory for identity key: %w", err)
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			return nil, fmt.Errorf("storing identity key: %w", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading identity key: %w", err)
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM data in %v", errIdentityKeyType, path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing identity key %v: %w", path, err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%w: %v", errIdentityKeyType, path)
+	}
+	return key, nil
+}
+
+func newIdentityKey(key *ecdsa.PrivateKey) *identityKey {
+	k := &identityKey{key: key}
+	jwk := k.jwk()
+	// The thumbprint hashes the required members in lexical order:
+	thumbprint := sha256.Sum256(fmt.Appendf(nil, `{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"]))
+	k.kid = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	return k
+}
+
+// jwk returns the key's public half as a JSON Web Key.
+func (k *identityKey) jwk() map[string]string {
+	ecdh, err := k.key.PublicKey.ECDH()
+	if err != nil {
+		panic(err) // P-256 keys are always valid ECDH keys
+	}
+	// The uncompressed point is 0x04 || x || y:
+	point := ecdh.Bytes()
+	jwk := map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(point[1:33]),
+		"y":   base64.RawURLEncoding.EncodeToString(point[33:]),
+		"use": "sig",
+		"alg": "ES256",
+	}
+	if k.kid != "" {
+		jwk["kid"] = k.kid
+	}
+	return jwk
+}
+
+// sign returns claims as a JWT, signed with ES256.
+func (k *identityKey) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT", "kid": k.kid})
+	if err != nil {
+		return "", fmt.Errorf("encoding token header: %w", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("encoding token claims: %w", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, k.key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing token: %w", err)
+	}
+	// JWS signatures are r || s, each padded to 32 bytes:
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// identityToken returns a token that asserts who made a request to
+// dest, valid for the service's -identityTokenLifetime. Its funnel
+// claim says whether who authenticated on the funnel, rather than
+// being a tailnet user.
+func (s *ValidTailnetSrv) identityToken(who *apitype.WhoIsResponse, dest *url.URL) (string, error) {
+	now := time.Now()
+	jti := make([]byte, 16)
+	_, _ = rand.Read(jti)
+	claims := map[string]any{
+		"iss":     s.Name,
+		"aud":     dest.String(),
+		"sub":     who.UserProfile.LoginName,
+		"iat":     now.Unix(),
+		"nbf":     now.Unix(),
+		"exp":     now.Add(s.IdentityTokenLifetime).Unix(),
+		"jti":     hex.EncodeToString(jti),
+		"user_id": who.UserProfile.ID.String(),
+		"name":    who.UserProfile.DisplayName,
+		"funnel":  who.Node == nil,
+	}
+	if who.Node != nil {
+		claims["node"] = who.Node.ComputedName
+		claims["node_id"] = who.Node.ID.String()
+		if len(who.Node.Tags) > 0 {
+			claims["tags"] = who.Node.Tags
+		}
+	}
+	return s.identityKey.sign(claims)
+}
+
+// setIdentityToken passes a token asserting who made r upstream, if
+// the service has -identityToken set and the requestor is known.
+func (s *ValidTailnetSrv) setIdentityToken(h http.Header, who *apitype.WhoIsResponse, dest *url.URL) {
+	if !s.IdentityToken || who == nil {
+		return
+	}
+	token, err := s.identityToken(who, dest)
+	if err != nil {
+		s.log().Warn("could not mint identity token", "error", err)
+		return
+	}
+	h.Set("X-Tailscale-Identity-Token", token)
+}
+
+// jwksHandler serves the keys that verify the services' identity
+// tokens, as a JSON Web Key Set.
+func (ss *Services) jwksHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		ss.mu.Lock()
+		keys := []map[string]string{}
+		seen := map[string]bool{}
+		for _, s := range ss.Services {
+			if s.identityKey != nil && !seen[s.identityKey.kid] {
+				seen[s.identityKey.kid] = true
+				keys = append(keys, s.identityKey.jwk())
+			}
+		}
+		ss.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{"keys": keys})
+	})
+}
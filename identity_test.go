@@ -0,0 +1,120 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// verifyJWT checks token's ES256 signature with the key from jwks
+// that its header names, and returns its claims.
+func verifyJWT(t *testing.T, jwks []byte, token string) map[string]any {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+	decode := func(part string) []byte {
+		decoded, err := base64.RawURLEncoding.DecodeString(part)
+		require.NoError(t, err)
+		return decoded
+	}
+	var header struct{ Alg, Kid string }
+	require.NoError(t, json.Unmarshal(decode(parts[0]), &header))
+	assert.Equal(t, "ES256", header.Alg)
+
+	var set struct{ Keys []map[string]string }
+	require.NoError(t, json.Unmarshal(jwks, &set))
+	var key *ecdsa.PublicKey
+	for _, jwk := range set.Keys {
+		if jwk["kid"] == header.Kid {
+			key = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(decode(jwk["x"])),
+				Y:     new(big.Int).SetBytes(decode(jwk["y"])),
+			}
+		}
+	}
+	require.NotNil(t, key, "the JWKS has the token's key")
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	signature := decode(parts[2])
+	require.Len(t, signature, 64)
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	require.True(t, ecdsa.Verify(key, digest[:], r, s), "signature is valid")
+
+	var claims map[string]any
+	require.NoError(t, json.Unmarshal(decode(parts[1]), &claims))
+	return claims
+}
+
+func TestIdentityToken(t *testing.T) {
+	t.Parallel()
+	headers := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	t.Cleanup(upstream.Close)
+
+	stateDir := t.TempDir()
+	args := []string{"tsnsrv", "-name", t.Name(), "-stateDir", stateDir, "-suppressWhois", "-identityToken", upstream.URL}
+	s, _, err := TailnetSrvFromArgs(args)
+	require.NoError(t, err)
+	require.NoError(t, s.loadIdentityKey())
+	s.whois = func(context.Context, string) (*apitype.WhoIsResponse, error) {
+		return whoIs("alice@example.com", "laptop", "tag:dev"), nil
+	}
+	proxy := httptest.NewServer(s.mux(http.DefaultTransport, false))
+	t.Cleanup(proxy.Close)
+	admin := httptest.NewServer((&Services{Services: []*ValidTailnetSrv{s}}).jwksHandler())
+	t.Cleanup(admin.Close)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Tailscale-Identity-Token", "forged")
+	resp, err := proxy.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	header := <-headers
+	assert.Empty(t, header.Get("X-Tailscale-User-LoginName"), "-suppressWhois still applies to the plain headers")
+
+	status, jwks := getBody(t, admin.Client(), admin.URL)
+	require.Equal(t, http.StatusOK, status)
+	claims := verifyJWT(t, []byte(jwks), header.Get("X-Tailscale-Identity-Token"))
+	assert.Equal(t, "alice@example.com", claims["sub"])
+	assert.Equal(t, upstream.URL, claims["aud"])
+	assert.Equal(t, t.Name(), claims["iss"])
+	assert.Equal(t, "laptop", claims["node"])
+	assert.Equal(t, []any{"tag:dev"}, claims["tags"])
+	assert.Subset(t, claims, map[string]any{"funnel": false})
+	assert.InDelta(t, time.Now().Add(time.Minute).Unix(), claims["exp"], 5)
+	localJWKS, err := os.ReadFile(filepath.Join(stateDir, identityJWKSFile))
+	require.NoError(t, err)
+	verifyJWT(t, localJWKS, header.Get("X-Tailscale-Identity-Token"))
+
+	funnelToken, err := s.identityToken(funnelUser("alice@example.com", "Alice"), s.DestURL)
+	require.NoError(t, err)
+	claims = verifyJWT(t, localJWKS, funnelToken)
+	assert.Subset(t, claims, map[string]any{"funnel": true, "sub": "funnel:alice@example.com"}, "funnel users can't pass for tailnet users")
+	assert.NotContains(t, claims, "node")
+
+	restarted, _, err := TailnetSrvFromArgs(args)
+	require.NoError(t, err)
+	require.NoError(t, restarted.loadIdentityKey())
+	assert.Equal(t, s.identityKey.kid, restarted.identityKey.kid, "the key persists in the -stateDir")
+
+	_, _, err = TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-prometheusAddr", "", "-identityToken", upstream.URL})
+	require.ErrorIs(t, err, errIdentityTokenNeedsAdmin)
+}
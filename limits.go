@@ -0,0 +1,184 @@
+package tsnsrv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var requestsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_requests_rejected",
+	Help: "Number of requests rejected by -funnelLimits and -tailnetLimits, by the limit they exceeded",
+}, []string{"service", "source", "limit"})
+
+// serverLimits restrict the requests that a service's HTTP listeners
+// accept, separately for the funnel and the tailnet. Zero values
+// mean no limit.
+type serverLimits struct {
+	maxBody            int64
+	maxHeader          int
+	readTimeout        time.Duration
+	writeTimeout       time.Duration
+	idleTimeout        time.Duration
+	maxRequests        int
+	maxRequestsPerAddr int
+}
+
+func (l *serverLimits) String() string {
+	var serialized []string
+	add := func(name string, value any, isSet bool) {
+		if isSet {
+			serialized = append(serialized, fmt.Sprintf("%s=%v", name, value))
+		}
+	}
+	add("maxBody", l.maxBody, l.maxBody != 0)
+	add("maxHeader", l.maxHeader, l.maxHeader != 0)
+	add("readTimeout", l.readTimeout, l.readTimeout != 0)
+	add("writeTimeout", l.writeTimeout, l.writeTimeout != 0)
+	add("idleTimeout", l.idleTimeout, l.idleTimeout != 0)
+	add("maxRequests", l.maxRequests, l.maxRequests != 0)
+	add("maxRequestsPerAddr", l.maxRequestsPerAddr, l.maxRequestsPerAddr != 0)
+	return strings.Join(serialized, ",")
+}
+
+// serverSettings returns the limits that the HTTP server enforces,
+// which only take effect when the service starts.
+func (l *serverLimits) serverSettings() string {
+	settings := *l
+	settings.maxBody, settings.maxRequests, settings.maxRequestsPerAddr = 0, 0, 0
+	return settings.String()
+}
+
+var errLimitsFormat = errors.New("limits must look like '<limit>=<value>[,...]', with limits maxBody, maxHeader (bytes, optionally with a KiB, MiB or GiB suffix), readTimeout, writeTimeout, idleTimeout (durations), maxRequests and maxRequestsPerAddr (counts)")
+
+var errByteCount = errors.New("invalid byte count")
+
+var byteUnits = map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30}
+
+// parseBytes parses a byte count like 512, 16KiB or 1MiB.
+func parseBytes(value string) (int64, error) {
+	multiplier := int64(1)
+	for suffix, unit := range byteUnits {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			value, multiplier = number, unit
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: %#v", errByteCount, value)
+	}
+	return n * multiplier, nil
+}
+
+// Set sets the limits given in value; giving the flag again sets more
+// (or overrides) limits.
+func (l *serverLimits) Set(value string) error {
+	for item := range strings.SplitSeq(value, ",") {
+		name, limit, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("%w: %#v", errLimitsFormat, item)
+		}
+		var err error
+		switch name {
+		case "maxBody":
+			l.maxBody, err = parseBytes(limit)
+		case "maxHeader":
+			var n int64
+			n, err = parseBytes(limit)
+			l.maxHeader = int(n)
+		case "readTimeout":
+			l.readTimeout, err = time.ParseDuration(limit)
+		case "writeTimeout":
+			l.writeTimeout, err = time.ParseDuration(limit)
+		case "idleTimeout":
+			l.idleTimeout, err = time.ParseDuration(limit)
+		case "maxRequests":
+			l.maxRequests, err = strconv.Atoi(limit)
+		case "maxRequestsPerAddr":
+			l.maxRequestsPerAddr, err = strconv.Atoi(limit)
+		default:
+			return fmt.Errorf("%w: unknown limit %#v", errLimitsFormat, name)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v: %w", errLimitsFormat, name, err)
+		}
+	}
+	return nil
+}
+
+// limits returns the limits for requests coming in via the funnel,
+// or from the tailnet.
+func (s *ValidTailnetSrv) limits(forFunnel bool) *serverLimits {
+	if forFunnel {
+		return &s.FunnelLimits
+	}
+	return &s.TailnetLimits
+}
+
+// sourceName returns the name that logs and metrics give requests'
+// provenance.
+func sourceName(forFunnel bool) string {
+	if forFunnel {
+		return "funnel"
+	}
+	return "tailnet"
+}
+
+// limitRequests answers requests that exceed the service's
+// -funnelLimits or -tailnetLimits: with a 413 status if their body
+// is too large, and with a 503 (or, if their address has too many
+// requests in flight, a 429) status if too many requests are in
+// flight already.
+func (s *ValidTailnetSrv) limitRequests(forFunnel bool, next http.Handler) http.Handler {
+	limits := s.limits(forFunnel)
+	if limits.maxBody == 0 && limits.maxRequests == 0 && limits.maxRequestsPerAddr == 0 {
+		return next
+	}
+	source := sourceName(forFunnel)
+	reject := func(w http.ResponseWriter, r *http.Request, limit string, status int) {
+		s.log().Warn("Rejected request over limits",
+			"url", r.URL,
+			"remote_addr", r.RemoteAddr,
+			"source", source,
+			"limit", limit,
+		)
+		requestsRejected.With(prometheus.Labels{"service": s.Name, "source": source, "limit": limit}).Inc()
+		http.Error(w, fmt.Sprintf("%d %s", status, http.StatusText(status)), status)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limits.maxBody > 0 {
+			if r.ContentLength > limits.maxBody {
+				reject(w, r, "maxBody", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limits.maxBody)
+		}
+		// Each source's requests in flight count under its name,
+		// and under its name and address:
+		addr := source + " " + identityOf(nil, r.RemoteAddr)
+		if !s.requests.acquire(source, limits.maxRequests) {
+			reject(w, r, "maxRequests", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.requests.release(source)
+		if !s.requests.acquire(addr, limits.maxRequestsPerAddr) {
+			reject(w, r, "maxRequestsPerAddr", http.StatusTooManyRequests)
+			return
+		}
+		defer s.requests.release(addr)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tooLarge returns whether err is from reading a request body that
+// exceeds -funnelLimits or -tailnetLimits' maxBody.
+func tooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
@@ -0,0 +1,117 @@
+package tsnsrv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerLimitsFormat(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		value    string
+		expected string
+	}{
+		{"maxBody=1MiB", "maxBody=1048576"},
+		{"maxHeader=16KiB,readTimeout=10s,writeTimeout=1m", "maxHeader=16384,readTimeout=10s,writeTimeout=1m0s"},
+		{"idleTimeout=30s,maxRequests=100,maxRequestsPerAddr=4", "idleTimeout=30s,maxRequests=100,maxRequestsPerAddr=4"},
+		{"maxBody", ""},
+		{"maxBody=-1", ""},
+		{"maxBody=1TiB", ""},
+		{"readTimeout=10", ""},
+		{"maxRequests=many", ""},
+		{"maxConnections=10", ""},
+	} {
+		test := elt
+		t.Run(test.value, func(t *testing.T) {
+			t.Parallel()
+			var limits serverLimits
+			err := limits.Set(test.value)
+			if test.expected == "" {
+				require.ErrorIs(t, err, errLimitsFormat)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, limits.String())
+		})
+	}
+
+	var limits serverLimits
+	require.ErrorIs(t, limits.Set("maxBody=1TiB"), errByteCount)
+}
+
+func TestServerLimits(t *testing.T) {
+	t.Parallel()
+	started, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-funnel",
+		"-funnelLimits", "maxBody=1KiB,maxRequestsPerAddr=1,maxHeader=4KiB,readTimeout=10s",
+		"-funnelLimits", "writeTimeout=20s",
+		upstream.URL,
+	})
+	require.NoError(t, err)
+	funnel := httptest.NewServer(s.mux(http.DefaultTransport, true))
+	t.Cleanup(funnel.Close)
+	tailnet := httptest.NewServer(s.mux(http.DefaultTransport, false))
+	t.Cleanup(tailnet.Close)
+
+	post := func(proxy *httptest.Server, path string, body io.Reader) int {
+		t.Helper()
+		resp, err := proxy.Client().Post(proxy.URL+path, "text/plain", body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	small, large := strings.Repeat("a", 1024), strings.Repeat("a", 1025)
+	assert.Equal(t, http.StatusOK, post(funnel, "/", strings.NewReader(small)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(funnel, "/", strings.NewReader(large)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(funnel, "/", io.MultiReader(strings.NewReader(large))), "without a content length")
+	assert.Equal(t, http.StatusOK, post(tailnet, "/", strings.NewReader(large)), "tailnet limits are separate")
+
+	slow := make(chan int)
+	go func() {
+		resp, err := funnel.Client().Post(funnel.URL+"/slow", "text/plain", nil)
+		if err != nil {
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	<-started
+	assert.Equal(t, http.StatusTooManyRequests, post(funnel, "/", nil), "only one request in flight per address")
+	assert.Equal(t, http.StatusOK, post(tailnet, "/", nil))
+	close(release)
+	assert.Equal(t, http.StatusOK, <-slow)
+	assert.Equal(t, http.StatusOK, post(funnel, "/", nil))
+
+	var funnelServer, tailnetServer *http.Server
+	for _, l := range s.Listeners {
+		server := s.newServer(l, &handlerSwitch{}).(*http.Server)
+		if l.forFunnel() {
+			funnelServer = server
+		} else {
+			tailnetServer = server
+		}
+	}
+	require.NotNil(t, funnelServer)
+	assert.Equal(t, 4096, funnelServer.MaxHeaderBytes)
+	assert.Equal(t, 10*time.Second, funnelServer.ReadTimeout)
+	assert.Equal(t, 20*time.Second, funnelServer.WriteTimeout)
+	require.NotNil(t, tailnetServer)
+	assert.Zero(t, tailnetServer.MaxHeaderBytes)
+	assert.Zero(t, tailnetServer.WriteTimeout)
+}
@@ -0,0 +1,201 @@
+package tsnsrv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type listenerMode int
+
+const (
+	listenTLS listenerMode = iota
+	listenPlaintext
+	listenFunnel
+	listenRedirect
+	listenTCP
+	listenUDP
+	listenPassthrough
+)
+
+var listenerModeNames = map[listenerMode]string{
+	listenTLS:         "tls",
+	listenPlaintext:   "plaintext",
+	listenFunnel:      "funnel",
+	listenRedirect:    "redirect",
+	listenTCP:         "tcp",
+	listenUDP:         "udp",
+	listenPassthrough: "passthrough",
+}
+
+func (m listenerMode) String() string {
+	return listenerModeNames[m]
+}
+
+// listener describes an address that a service's node listens on,
+// and how it serves requests there.
+type listener struct {
+	addr     string
+	mode     listenerMode
+	prefixes prefixes
+}
+
+// forFunnel returns whether the listener serves requests coming in via the funnel.
+func (l *listener) forFunnel() bool {
+	return l.mode == listenFunnel
+}
+
+// forwardsConns returns whether the listener forwards whole
+// connections (or UDP flows) instead of HTTP requests.
+func (l *listener) forwardsConns() bool {
+	return l.mode == listenTCP || l.mode == listenUDP || l.mode == listenPassthrough
+}
+
+// endpoint identifies the listener's address and mode, but not the
+// way it serves requests.
+func (l *listener) endpoint() string {
+	return fmt.Sprintf("%s,%s", l.addr, l.mode)
+}
+
+func (l *listener) String() string {
+	s := l.endpoint()
+	for _, pref := range l.prefixes {
+		s += ",prefix=" + pref.String()
+	}
+	return s
+}
+
+type listeners []listener
+
+func (ls *listeners) String() string {
+	var serialized []string
+	for _, l := range *ls {
+		serialized = append(serialized, l.String())
+	}
+	return strings.Join(serialized, " ")
+}
+
+var errListenerFormat = errors.New("listeners must look like '<addr>[,tls|plaintext|funnel|redirect|tcp|udp|passthrough][,prefix=<prefix>...]'")
+
+func (ls *listeners) Set(value string) error {
+	addr, options, _ := strings.Cut(value, ",")
+	if addr == "" {
+		return fmt.Errorf("%w: missing address in %#v", errListenerFormat, value)
+	}
+	l := listener{addr: addr}
+	for option := range strings.SplitSeq(options, ",") {
+		if option == "" {
+			continue
+		}
+		if pref, ok := strings.CutPrefix(option, "prefix="); ok {
+			if err := l.prefixes.Set(pref); err != nil {
+				return err
+			}
+			continue
+		}
+		mode, ok := listenerModeByName(option)
+		if !ok {
+			return fmt.Errorf("%w: unknown option %#v in %#v", errListenerFormat, option, value)
+		}
+		l.mode = mode
+	}
+	*ls = append(*ls, l)
+	return nil
+}
+
+func listenerModeByName(name string) (listenerMode, bool) {
+	for mode, modeName := range listenerModeNames {
+		if modeName == name {
+			return mode, true
+		}
+	}
+	return 0, false
+}
+
+// endpoints returns the listeners' addresses and modes.
+func (ls listeners) endpoints() string {
+	var endpoints []string
+	for _, l := range ls {
+		endpoints = append(endpoints, l.endpoint())
+	}
+	return strings.Join(endpoints, " ")
+}
+
+var errListenCombined = errors.New("-listen can not be combined with -funnel, -funnelOnly or -plaintext")
+var errDuplicateListener = errors.New("there can only be one tailnet, one funnel and one udp listener on each address")
+var errRedirectNeedsTLS = errors.New("redirect listeners need a tls listener to redirect to")
+var errPrefixesNeedHTTP = errors.New("only HTTP listeners can have prefixes")
+var errUDPNeedsNetworkUpstream = errors.New("udp listeners can't forward to unix: upstreams, which don't keep datagrams apart")
+
+// validateListeners checks the -listen flags, and if there are none,
+// sets up listeners as the older -listenAddr, -plaintext, -funnel and
+// -funnelOnly flags describe.
+func (s *TailnetSrv) validateListeners() []error {
+	if len(s.Listeners) == 0 {
+		if !s.FunnelOnly {
+			mode := listenTLS
+			if s.ServePlaintext {
+				mode = listenPlaintext
+			}
+			s.Listeners = append(s.Listeners, listener{addr: s.ListenAddr, mode: mode})
+		}
+		if s.Funnel {
+			s.Listeners = append(s.Listeners, listener{addr: s.ListenAddr, mode: listenFunnel})
+		}
+		return nil
+	}
+
+	var errs []error
+	if s.Funnel || s.FunnelOnly || s.ServePlaintext {
+		errs = append(errs, errListenCombined)
+	}
+	seen := map[string]bool{}
+	for _, l := range s.Listeners {
+		key := fmt.Sprintf("%s,%v,%v", l.addr, l.forFunnel(), l.mode == listenUDP)
+		if seen[key] {
+			errs = append(errs, fmt.Errorf("%w: %v", errDuplicateListener, l.addr))
+		}
+		seen[key] = true
+		if l.forwardsConns() && len(l.prefixes) > 0 {
+			errs = append(errs, fmt.Errorf("%w: %v", errPrefixesNeedHTTP, l.endpoint()))
+		}
+	}
+	if slices.ContainsFunc(s.Listeners, func(l listener) bool { return l.mode == listenUDP }) &&
+		slices.ContainsFunc(s.upstreamAddrs(), func(a upstreamAddr) bool { return a.kind == upstreamUnix }) {
+		errs = append(errs, errUDPNeedsNetworkUpstream)
+	}
+	if slices.ContainsFunc(s.Listeners, func(l listener) bool { return l.mode == listenRedirect }) &&
+		!slices.ContainsFunc(s.Listeners, func(l listener) bool { return l.mode == listenTLS }) {
+		errs = append(errs, errRedirectNeedsTLS)
+	}
+	return errs
+}
+
+// redirectHandler sends requests to the service's first TLS
+// listener, on the node's full MagicDNS name (the first of its
+// certDomains).
+func (s *ValidTailnetSrv) redirectHandler(certDomains func() []string) http.Handler {
+	port := ""
+	for _, l := range s.Listeners {
+		if l.mode == listenTLS {
+			_, port, _ = net.SplitHostPort(l.addr)
+			break
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if domains := certDomains(); len(domains) > 0 {
+			host = domains[0]
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
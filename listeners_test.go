@@ -0,0 +1,111 @@
+package tsnsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListeners(t *testing.T) {
+	for _, elt := range []struct {
+		name     string
+		args     []string
+		expected string
+		ok       bool
+	}{
+		{"default", []string{}, ":443,tls", true},
+		{"plaintext", []string{"-plaintext", "-listenAddr=:80"}, ":80,plaintext", true},
+		{"funnel", []string{"-funnel"}, ":443,tls :443,funnel", true},
+		{"funnelOnly", []string{"-funnel", "-funnelOnly", "-listenAddr=:8443"}, ":8443,funnel", true},
+		{"several", []string{"-listen=:443", "-listen=:80,redirect", "-listen=:8443,funnel,prefix=/hook"}, ":443,tls :80,redirect :8443,funnel,prefix=/hook", true},
+		{"tailnet and funnel on one port", []string{"-listen=:443,tls", "-listen=:443,funnel"}, ":443,tls :443,funnel", true},
+
+		// Expected to fail:
+		{"unknown mode", []string{"-listen=:443,carrier-pigeon"}, "", false},
+		{"no address", []string{"-listen=,tls"}, "", false},
+		{"combined with funnel", []string{"-funnel", "-listen=:443"}, "", false},
+		{"duplicate", []string{"-listen=:443", "-listen=:443,plaintext"}, "", false},
+		{"redirect without tls", []string{"-listen=:80,redirect", "-listen=:8080,plaintext"}, "", false},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			s := &TailnetSrv{}
+			fs := quietFlagSet(s.flagSet())
+			err := fs.Parse(append(append([]string{"-name=foo"}, test.args...), "http://example.com"))
+			if err == nil {
+				var valid *ValidTailnetSrv
+				valid, err = s.validate(fs.Args())
+				if err == nil {
+					assert.Equal(t, test.expected, valid.Listeners.String())
+				}
+			}
+			if test.ok {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestListenerPrefixes(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(ts.Close)
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "TestListenerPrefixes",
+		"-prefix", "/ui",
+		"-listen", ":443",
+		"-listen", ":8443,funnel,prefix=/hook",
+		ts.URL,
+	})
+	require.NoError(t, err)
+
+	for _, elt := range []struct {
+		listener int
+		path     string
+		status   int
+	}{
+		{0, "/ui", http.StatusOK},
+		{0, "/hook", http.StatusNotFound},
+		{1, "/ui", http.StatusNotFound},
+		{1, "/hook", http.StatusOK},
+	} {
+		proxy := httptest.NewServer(s.handler(http.DefaultTransport, &s.Listeners[elt.listener]))
+		resp, err := proxy.Client().Get(proxy.URL + elt.path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, elt.status, resp.StatusCode, "%v on %v", elt.path, s.Listeners[elt.listener].String())
+		proxy.Close()
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	for _, elt := range []struct {
+		name, tlsAddr string
+		domains       []string
+		expected      string
+	}{
+		{"default port", ":443", []string{"foo.example.ts.net"}, "https://foo.example.ts.net/some/path?q=1"},
+		{"other port", ":8443", []string{"foo.example.ts.net"}, "https://foo.example.ts.net:8443/some/path?q=1"},
+		{"no MagicDNS name", ":443", nil, "https://foo/some/path?q=1"},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo",
+				"-listen", test.tlsAddr, "-listen", ":80,redirect", "http://example.com",
+			})
+			require.NoError(t, err)
+			handler := s.redirectHandler(func() []string { return test.domains })
+			req := httptest.NewRequest(http.MethodGet, "http://foo:80/some/path?q=1", nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+			assert.Equal(t, test.expected, rec.Header().Get("Location"))
+		})
+	}
+}
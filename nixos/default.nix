@@ -132,8 +132,8 @@
         };
 
         prefixes = mkOption {
-          description = "URL path prefixes to allow in forwarding. Acts as an allowlist but if no prefixes are set, all prefixes are allowed.";
-          type = types.listOf (types.strMatching "^(/|tailnet:/|funnel:/).*");
+          description = "URL path prefixes to allow in forwarding, as `[tailnet:|funnel:][strip:|nostrip:][grpcweb:][host]/path[=URL]`. Acts as an allowlist but if no prefixes are set, all prefixes are allowed.";
+          type = types.listOf (types.strMatching "^((tailnet|funnel|strip|nostrip|grpcweb):)*[^:/]*/.*");
           default = [];
           example = [
             "tailnet:/"
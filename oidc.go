@@ -0,0 +1,382 @@
+package tsnsrv
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var oidcLogins = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_oidc_logins",
+	Help: "Number of OIDC logins that the service's -oidcPrefix provider issued tokens for, by client",
+}, []string{"service", "client"})
+
+const (
+	// oidcCodeLifetime is how long authorization codes can be
+	// exchanged for tokens.
+	oidcCodeLifetime = time.Minute
+	// oidcTokenLifetime is how long ID and access tokens are valid.
+	oidcTokenLifetime = time.Hour
+)
+
+// oidcClient is an app that can log users in with the service's
+// OIDC provider.
+type oidcClient struct {
+	id           string
+	secretFile   string
+	redirectURIs []string
+}
+
+type oidcClients []oidcClient
+
+func (cs *oidcClients) String() string {
+	var serialized []string
+	for _, c := range *cs {
+		serialized = append(serialized, c.id+":"+c.secretFile+"="+strings.Join(c.redirectURIs, ","))
+	}
+	return strings.Join(serialized, " ")
+}
+
+var errOIDCClientFormat = errors.New("OIDC clients must look like '<client id>:<client secret file>=<redirect URI>[,<redirect URI>...]'")
+
+func (cs *oidcClients) Set(value string) error {
+	credentials, uris, ok := strings.Cut(value, "=")
+	id, secretFile, hasSecret := strings.Cut(credentials, ":")
+	if !ok || !hasSecret || id == "" || secretFile == "" || uris == "" {
+		return fmt.Errorf("%w: %#v", errOIDCClientFormat, value)
+	}
+	client := oidcClient{id: id, secretFile: secretFile}
+	for uri := range strings.SplitSeq(uris, ",") {
+		parsed, err := url.Parse(uri)
+		if err != nil || !parsed.IsAbs() {
+			return fmt.Errorf("%w: invalid redirect URI %#v", errOIDCClientFormat, uri)
+		}
+		client.redirectURIs = append(client.redirectURIs, uri)
+	}
+	*cs = append(*cs, client)
+	return nil
+}
+
+var errOIDCPrefix = errors.New("-oidcPrefix must look like '/<path>', without a trailing slash")
+var errOIDCClientsNeedPrefix = errors.New("-oidcClient needs an -oidcPrefix")
+
+func (s *TailnetSrv) validateOIDC() []error {
+	var errs []error
+	if s.OIDCPrefix != "" && (!strings.HasPrefix(s.OIDCPrefix, "/") || strings.HasSuffix(s.OIDCPrefix, "/")) {
+		errs = append(errs, fmt.Errorf("%w: %#v", errOIDCPrefix, s.OIDCPrefix))
+	}
+	if len(s.OIDCClients) > 0 && s.OIDCPrefix == "" {
+		errs = append(errs, errOIDCClientsNeedPrefix)
+	}
+	return errs
+}
+
+// loadOIDCSecrets reads the secrets of the service's -oidcClient
+// apps, if they aren't loaded yet.
+func (s *ValidTailnetSrv) loadOIDCSecrets() error {
+	if s.oidcSecrets != nil {
+		return nil
+	}
+	secrets := map[string]string{}
+	for _, c := range s.OIDCClients {
+		secret, err := os.ReadFile(c.secretFile)
+		if err != nil {
+			return fmt.Errorf("reading secret of OIDC client %v: %w", c.id, err)
+		}
+		secrets[c.id] = strings.TrimSpace(string(secret))
+	}
+	s.oidcSecrets = secrets
+	return nil
+}
+
+// oidcGrant is what an authorization code or access token stands for.
+type oidcGrant struct {
+	client        string
+	redirectURI   string
+	issuer        string
+	nonce         string
+	codeChallenge string
+	claims        map[string]any // the userinfo claims
+	expires       time.Time
+}
+
+// oidcGrants holds the authorization codes and access tokens that
+// haven't expired yet. It is shared by a service's configurations
+// over reloads.
+type oidcGrants struct {
+	mu     sync.Mutex
+	codes  map[string]*oidcGrant
+	tokens map[string]*oidcGrant
+}
+
+// issue stores g under a new random key in grants, and returns the key.
+func (og *oidcGrants) issue(grants *map[string]*oidcGrant, g *oidcGrant) string {
+	key := rand.Text()
+	og.mu.Lock()
+	defer og.mu.Unlock()
+	now := time.Now()
+	for k, other := range *grants {
+		if now.After(other.expires) {
+			delete(*grants, k)
+		}
+	}
+	if *grants == nil {
+		*grants = map[string]*oidcGrant{}
+	}
+	(*grants)[key] = g
+	return key
+}
+
+// redeemCode returns the grant for an authorization code, which can
+// only be redeemed once.
+func (og *oidcGrants) redeemCode(code string) *oidcGrant {
+	og.mu.Lock()
+	defer og.mu.Unlock()
+	g := og.codes[code]
+	delete(og.codes, code)
+	if g == nil || time.Now().After(g.expires) {
+		return nil
+	}
+	return g
+}
+
+func (og *oidcGrants) lookupToken(token string) *oidcGrant {
+	og.mu.Lock()
+	defer og.mu.Unlock()
+	g := og.tokens[token]
+	if g == nil || time.Now().After(g.expires) {
+		return nil
+	}
+	return g
+}
+
+// oidcClaims returns the userinfo claims about who. Tagged nodes all
+// share one user, so they log in as themselves: with a subject like
+// "node:<stable node ID>", and their node name as their login.
+func oidcClaims(who *apitype.WhoIsResponse) map[string]any {
+	if len(who.Node.Tags) > 0 {
+		return map[string]any{
+			"sub":                "node:" + string(who.Node.StableID),
+			"preferred_username": who.Node.ComputedName,
+			"name":               who.Node.ComputedName,
+			"tags":               who.Node.Tags,
+		}
+	}
+	login := who.UserProfile.LoginName
+	claims := map[string]any{
+		"sub":                who.UserProfile.ID.String(),
+		"preferred_username": login,
+		"name":               who.UserProfile.DisplayName,
+	}
+	if strings.Contains(login, "@") {
+		claims["email"] = login
+		claims["email_verified"] = true
+	}
+	if who.UserProfile.ProfilePicURL != "" {
+		claims["picture"] = who.UserProfile.ProfilePicURL
+	}
+	return claims
+}
+
+// oidcProvider serves the service's OIDC provider under its
+// -oidcPrefix. It logs users in without asking them anything, as
+// whoever they are on the tailnet. Only the authorization endpoint
+// checks who makes requests: the others get them from the app's
+// server, on its users' behalf.
+func (s *ValidTailnetSrv) oidcProvider() http.Handler {
+	mux := http.NewServeMux()
+	prefix := s.OIDCPrefix
+	issuer := func(r *http.Request) string {
+		scheme := "https"
+		if r.TLS == nil {
+			scheme = "http"
+		}
+		return scheme + "://" + r.Host + prefix
+	}
+	mux.HandleFunc("GET "+prefix+"/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		iss := issuer(r)
+		writeJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                iss,
+			"authorization_endpoint":                iss + "/authorize",
+			"token_endpoint":                        iss + "/token",
+			"userinfo_endpoint":                     iss + "/userinfo",
+			"jwks_uri":                              iss + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"ES256"},
+			"scopes_supported":                      []string{"openid", "profile", "email"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+			"code_challenge_methods_supported":      []string{"S256"},
+			"claims_supported":                      []string{"sub", "preferred_username", "name", "email", "email_verified", "picture", "tags"},
+		})
+	})
+	mux.HandleFunc("GET "+prefix+"/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{s.identityKey.jwk()}})
+	})
+	mux.Handle("GET "+prefix+"/authorize", s.identify(false, s.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.oidcAuthorize(w, r, issuer(r))
+	}))))
+	mux.HandleFunc("POST "+prefix+"/token", s.oidcToken)
+	mux.HandleFunc(prefix+"/userinfo", s.oidcUserinfo)
+	return mux
+}
+
+// oidcAuthorize issues an authorization code for the requestor, and
+// redirects them back to the client with it.
+func (s *ValidTailnetSrv) oidcAuthorize(w http.ResponseWriter, r *http.Request, issuer string) {
+	q := r.URL.Query()
+	clientID, redirectURI := q.Get("client_id"), q.Get("redirect_uri")
+	i := slices.IndexFunc(s.OIDCClients, func(c oidcClient) bool { return c.id == clientID })
+	if i < 0 || !slices.Contains(s.OIDCClients[i].redirectURIs, redirectURI) {
+		// Never redirect anywhere that the client didn't register:
+		http.Error(w, "400 Bad Request: unknown client or redirect URI", http.StatusBadRequest)
+		return
+	}
+	redirect := func(params url.Values) {
+		target, _ := url.Parse(redirectURI)
+		query := target.Query()
+		for name, values := range params {
+			query[name] = values
+		}
+		if state := q.Get("state"); state != "" {
+			query.Set("state", state)
+		}
+		target.RawQuery = query.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	}
+	oidcError := func(code, description string) {
+		redirect(url.Values{"error": {code}, "error_description": {description}})
+	}
+	who, _ := r.Context().Value(whoContextKey).(*apitype.WhoIsResponse)
+	switch {
+	case q.Get("response_type") != "code":
+		oidcError("unsupported_response_type", "only the code flow is supported")
+		return
+	case !slices.Contains(strings.Fields(q.Get("scope")), "openid"):
+		oidcError("invalid_scope", "the openid scope is required")
+		return
+	case q.Get("code_challenge") != "" && q.Get("code_challenge_method") != "S256":
+		oidcError("invalid_request", "only S256 code challenges are supported")
+		return
+	case who == nil || who.Node == nil:
+		oidcError("access_denied", "only tailnet users can log in")
+		return
+	}
+	code := s.oidcGrants.issue(&s.oidcGrants.codes, &oidcGrant{
+		client:        clientID,
+		redirectURI:   redirectURI,
+		issuer:        issuer,
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		claims:        oidcClaims(who),
+		expires:       time.Now().Add(oidcCodeLifetime),
+	})
+	redirect(url.Values{"code": {code}})
+}
+
+// oidcToken exchanges authorization codes for ID and access tokens.
+func (s *ValidTailnetSrv) oidcToken(w http.ResponseWriter, r *http.Request) {
+	oidcError := func(status int, code, description string) {
+		writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+	}
+	if err := r.ParseForm(); err != nil {
+		oidcError(http.StatusBadRequest, "invalid_request", "could not parse the form")
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	expected, known := s.oidcSecrets[clientID]
+	if !known || subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+s.OIDCPrefix+`"`)
+		oidcError(http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oidcError(http.StatusBadRequest, "unsupported_grant_type", "only authorization codes can be exchanged")
+		return
+	}
+	g := s.oidcGrants.redeemCode(r.PostForm.Get("code"))
+	if g == nil || g.client != clientID || g.redirectURI != r.PostForm.Get("redirect_uri") {
+		oidcError(http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		return
+	}
+	if g.codeChallenge != "" {
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(verifier[:]) != g.codeChallenge {
+			oidcError(http.StatusBadRequest, "invalid_grant", "code verifier does not match the challenge")
+			return
+		}
+	}
+
+	now := time.Now()
+	idClaims := map[string]any{
+		"iss":       g.issuer,
+		"aud":       clientID,
+		"iat":       now.Unix(),
+		"auth_time": now.Unix(),
+		"exp":       now.Add(oidcTokenLifetime).Unix(),
+	}
+	for name, value := range g.claims {
+		idClaims[name] = value
+	}
+	if g.nonce != "" {
+		idClaims["nonce"] = g.nonce
+	}
+	idToken, err := s.identityKey.sign(idClaims)
+	if err != nil {
+		s.log().Error("could not sign OIDC ID token", "error", err)
+		oidcError(http.StatusInternalServerError, "server_error", "could not sign the ID token")
+		return
+	}
+	accessToken := s.oidcGrants.issue(&s.oidcGrants.tokens, &oidcGrant{
+		client:  clientID,
+		claims:  g.claims,
+		expires: now.Add(oidcTokenLifetime),
+	})
+	s.log().Info("Issued OIDC tokens", "client", clientID, "login", g.claims["preferred_username"])
+	oidcLogins.With(prometheus.Labels{"service": s.Name, "client": clientID}).Inc()
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(oidcTokenLifetime.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// oidcUserinfo returns the claims about the user that an access
+// token was issued to.
+func (s *ValidTailnetSrv) oidcUserinfo(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	g := s.oidcGrants.lookupToken(token)
+	if !ok || g == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, g.claims)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
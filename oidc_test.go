@@ -0,0 +1,190 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func TestOIDCClientFormat(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		value string
+		valid bool
+	}{
+		{"grafana:/run/secrets/grafana=https://grafana.example.com/login/generic_oauth", true},
+		{"gitea:secret=https://git.example.com/a,https://git.example.com/b", true},
+		{"grafana=https://grafana.example.com/", false},
+		{":secret=https://grafana.example.com/", false},
+		{"grafana:secret=", false},
+		{"grafana:secret=/relative", false},
+	} {
+		test := elt
+		t.Run(test.value, func(t *testing.T) {
+			t.Parallel()
+			var clients oidcClients
+			err := clients.Set(test.value)
+			if test.valid {
+				require.NoError(t, err)
+				assert.Equal(t, test.value, clients.String())
+			} else {
+				require.ErrorIs(t, err, errOIDCClientFormat)
+			}
+		})
+	}
+
+	_, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-oidcClient", "app:secret=https://app.example.com/", "http://example.com"})
+	require.ErrorIs(t, err, errOIDCClientsNeedPrefix)
+	_, _, err = TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-oidcPrefix", "/oidc/", "http://example.com"})
+	require.ErrorIs(t, err, errOIDCPrefix)
+}
+
+func TestOIDCProvider(t *testing.T) {
+	t.Parallel()
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("s3cret\n"), 0o600))
+	const callback = "https://app.example.com/callback"
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-stateDir", t.TempDir(),
+		"-oidcPrefix", "/oidc",
+		"-oidcClient", "app:" + secretFile + "=" + callback,
+		"-allow", "user:alice@example.com,tag:kiosk",
+		"http://" + namedUpstream(t, "upstream"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.loadIdentityKey())
+	require.NoError(t, s.loadOIDCSecrets())
+	// The app's server makes all requests but those to /authorize:
+	alice, appServer := whoIs("alice@example.com", "laptop"), whoIs("tagged-devices", "app", "tag:server")
+	var who atomic.Pointer[apitype.WhoIsResponse]
+	who.Store(appServer)
+	s.whois = func(context.Context, string) (*apitype.WhoIsResponse, error) {
+		return who.Load(), nil
+	}
+	proxy := httptest.NewServer(s.mux(http.DefaultTransport, false))
+	t.Cleanup(proxy.Close)
+	client := proxy.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	issuer := proxy.URL + "/oidc"
+
+	getJSON := func(path string, into any) {
+		t.Helper()
+		status, body := getBody(t, client, proxy.URL+path)
+		require.Equal(t, http.StatusOK, status, body)
+		require.NoError(t, json.Unmarshal([]byte(body), into))
+	}
+	var discovery map[string]any
+	getJSON("/oidc/.well-known/openid-configuration", &discovery)
+	assert.Equal(t, issuer, discovery["issuer"])
+	assert.Equal(t, issuer+"/token", discovery["token_endpoint"])
+	status, _ := getBody(t, client, proxy.URL+"/elsewhere")
+	assert.Equal(t, http.StatusForbidden, status, "other paths still go upstream, if -allow lets them")
+
+	authorize := func(as *apitype.WhoIsResponse, params url.Values) *http.Response {
+		t.Helper()
+		who.Store(as)
+		defer who.Store(appServer)
+		resp, err := client.Get(issuer + "/authorize?" + params.Encode())
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	verifier := "a-code-verifier-that-is-long-enough-for-pkce-0123456789"
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"app"},
+		"redirect_uri":          {callback},
+		"scope":                 {"openid profile email"},
+		"state":                 {"st4te"},
+		"nonce":                 {"n0nce"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	resp := authorize(alice, params)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "app.example.com", location.Host)
+	assert.Equal(t, "st4te", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	require.NotEmpty(t, code)
+
+	token := func(secret, code, verifier string) (int, map[string]any) {
+		t.Helper()
+		form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {callback}, "code_verifier": {verifier}}
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, issuer+"/token", strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("app", secret)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var answer map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&answer))
+		return resp.StatusCode, answer
+	}
+	status, answer := token("wrong", code, verifier)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "invalid_client", answer["error"])
+	status, answer = token("s3cret", code, verifier)
+	require.Equal(t, http.StatusOK, status, answer)
+
+	_, jwks := getBody(t, client, issuer+"/jwks")
+	claims := verifyJWT(t, []byte(jwks), answer["id_token"].(string))
+	assert.Equal(t, issuer, claims["iss"])
+	assert.Equal(t, "app", claims["aud"])
+	assert.Equal(t, "n0nce", claims["nonce"])
+	assert.Equal(t, "alice@example.com", claims["preferred_username"])
+	assert.Equal(t, "alice@example.com", claims["email"])
+	assert.NotContains(t, claims, "tags", "users' nodes have no tags")
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, issuer+"/userinfo", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+answer["access_token"].(string))
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	userinfo, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(userinfo), `"preferred_username":"alice@example.com"`)
+
+	status, answer = token("s3cret", code, verifier)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_grant", answer["error"], "codes can only be redeemed once")
+	location, err = url.Parse(authorize(alice, params).Header.Get("Location"))
+	require.NoError(t, err)
+	status, answer = token("s3cret", location.Query().Get("code"), "wrong verifier")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_grant", answer["error"], "the code verifier must match")
+
+	kiosk := whoIs("tagged-devices", "kiosk", "tag:kiosk")
+	kiosk.Node.StableID = "nK1osk"
+	location, err = url.Parse(authorize(kiosk, params).Header.Get("Location"))
+	require.NoError(t, err)
+	status, answer = token("s3cret", location.Query().Get("code"), verifier)
+	require.Equal(t, http.StatusOK, status, answer)
+	claims = verifyJWT(t, []byte(jwks), answer["id_token"].(string))
+	assert.Equal(t, "node:nK1osk", claims["sub"], "tagged nodes log in as themselves")
+	assert.Equal(t, "kiosk", claims["preferred_username"])
+	assert.Equal(t, []any{"tag:kiosk"}, claims["tags"])
+	assert.NotContains(t, claims, "email")
+	assert.Equal(t, http.StatusForbidden, authorize(whoIs("mallory@example.com", "laptop"), params).StatusCode, "-allow rules apply to logins")
+
+	params.Set("redirect_uri", "https://evil.example.com/")
+	assert.Equal(t, http.StatusBadRequest, authorize(alice, params).StatusCode, "unregistered redirect URIs are never redirected to")
+}
@@ -0,0 +1,158 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// sniRoute sends passthrough connections for a server name (or, with
+// a leading "*.", for any name directly below a domain) to its own
+// upstream addresses.
+type sniRoute struct {
+	serverName string
+	addrs      upstreamAddrs
+}
+
+// matches returns whether the route applies to connections that ask for serverName.
+func (r *sniRoute) matches(serverName string) bool {
+	return serverNameMatches(r.serverName, serverName)
+}
+
+// serverNameMatches returns whether serverName is pattern, or (if
+// pattern starts with "*.") directly below pattern's domain.
+func serverNameMatches(pattern, serverName string) bool {
+	if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+		_, parent, found := strings.Cut(serverName, ".")
+		return found && strings.EqualFold(parent, domain)
+	}
+	return strings.EqualFold(serverName, pattern)
+}
+
+// validServerNamePattern returns whether pattern is a server name,
+// optionally starting with "*.".
+func validServerNamePattern(pattern string) bool {
+	name := strings.TrimPrefix(pattern, "*.")
+	return name != "" && !strings.Contains(name, "*")
+}
+
+type sniRoutes []sniRoute
+
+func (rs *sniRoutes) String() string {
+	var serialized []string
+	for _, r := range *rs {
+		for _, addr := range r.addrs {
+			serialized = append(serialized, r.serverName+"="+addr.String())
+		}
+	}
+	return strings.Join(serialized, ", ")
+}
+
+var errSNIRouteFormat = errors.New("SNI routes must look like '[*.]<server name>=<upstream address>', with an upstream address as in -upstream")
+
+func (rs *sniRoutes) Set(value string) error {
+	serverName, addr, ok := strings.Cut(value, "=")
+	if !ok || !validServerNamePattern(serverName) {
+		return fmt.Errorf("%w: %#v", errSNIRouteFormat, value)
+	}
+	var addrs upstreamAddrs
+	if err := addrs.Set(addr); err != nil {
+		return fmt.Errorf("%w: %w", errSNIRouteFormat, err)
+	}
+	for i := range *rs {
+		if strings.EqualFold((*rs)[i].serverName, serverName) {
+			(*rs)[i].addrs = append((*rs)[i].addrs, addrs...)
+			return nil
+		}
+	}
+	*rs = append(*rs, sniRoute{serverName, addrs})
+	return nil
+}
+
+var errSNIRoutesNeedPassthrough = errors.New("-sniRoute needs a passthrough listener")
+
+// sniRouter picks the upstream pool for passthrough connections, by
+// the server name that their clients ask for.
+type sniRouter struct {
+	routes   sniRoutes
+	pools    []*upstreamPool // one for each of the routes
+	fallback *upstreamPool
+}
+
+// newSNIRouter returns a router for the service's -sniRoute flags,
+// which sends connections that none of them match to fallback.
+func (s *ValidTailnetSrv) newSNIRouter(fallback *upstreamPool) *sniRouter {
+	// The routes' pools only ever dial connections, they never make requests:
+	newTransport := func(dial dialFunc) *http.Transport { return &http.Transport{DialContext: dial} }
+	router := &sniRouter{routes: s.SNIRoutes, fallback: fallback}
+	for _, route := range s.SNIRoutes {
+		router.pools = append(router.pools, s.addrPool(route.addrs, newTransport))
+	}
+	return router
+}
+
+// route returns the pool for connections that ask for serverName:
+// that of the first route matching it, or else the fallback.
+func (r *sniRouter) route(serverName string) *upstreamPool {
+	for i := range r.routes {
+		if r.routes[i].matches(serverName) {
+			return r.pools[i]
+		}
+	}
+	return r.fallback
+}
+
+// errHelloRead stops the TLS handshake once the ClientHello is in.
+var errHelloRead = errors.New("read the TLS ClientHello")
+
+// helloConn lets a TLS server read a connection's ClientHello, but
+// throws away everything it writes.
+type helloConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *helloConn) Read(b []byte) (int, error) { return c.reader.Read(b) } //nolint:wrapcheck // only the TLS server sees these
+
+func (c *helloConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// replayConn is a connection whose first bytes were read already,
+// and which reads them again.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) { return c.reader.Read(b) } //nolint:wrapcheck // passed through like the connection's own errors
+
+func (c *replayConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite() //nolint:wrapcheck // passed through like the connection's own errors
+	}
+	return c.Conn.Close() //nolint:wrapcheck // passed through like the connection's own errors
+}
+
+// readServerName reads the TLS ClientHello that conn starts with,
+// and returns the server name that it asks for, along with a
+// connection that reads the whole unmodified stream again.
+func readServerName(ctx context.Context, conn net.Conn) (string, net.Conn, error) {
+	var hello bytes.Buffer
+	var serverName string
+	err := tls.Server(&helloConn{conn, io.TeeReader(conn, &hello)}, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errHelloRead
+		},
+	}).HandshakeContext(ctx)
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, fmt.Errorf("reading the TLS ClientHello: %w", err)
+	}
+	return serverName, &replayConn{conn, io.MultiReader(&hello, conn)}, nil
+}
@@ -0,0 +1,107 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSNIRouteFormat(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		value string
+		ok    bool
+	}{
+		{"db.example.com=tcp:127.0.0.1:5432", true},
+		{"*.example.com=unix:/run/app.sock", true},
+
+		// Expected to fail:
+		{"db.example.com", false},
+		{"=tcp:127.0.0.1:5432", false},
+		{"*.=tcp:127.0.0.1:5432", false},
+		{"db.*.example.com=tcp:127.0.0.1:5432", false},
+		{"db.example.com=127.0.0.1:5432", false},
+	} {
+		test := elt
+		t.Run(test.value, func(t *testing.T) {
+			t.Parallel()
+			var routes sniRoutes
+			err := routes.Set(test.value)
+			if !test.ok {
+				assert.ErrorIs(t, err, errSNIRouteFormat)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.value, routes.String())
+		})
+	}
+
+	_, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-sniRoute", "db.example.com=tcp:127.0.0.1:5432", "https://127.0.0.1:8443"})
+	require.ErrorIs(t, err, errSNIRoutesNeedPassthrough)
+}
+
+// tlsUpstream returns the address of an HTTPS server that answers
+// requests with name.
+func tlsUpstream(t *testing.T, name string) string {
+	t.Helper()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+func TestPassthrough(t *testing.T) {
+	t.Parallel()
+	s := poolService(t, []string{"-listen", ":443,passthrough",
+		"-sniRoute", "a.example.com=tcp:" + tlsUpstream(t, "a"),
+		"-sniRoute", "*.b.example.com=tcp:" + tlsUpstream(t, "b"),
+	}, tlsUpstream(t, "default"))
+	addr, _ := serveTCP(t, s)
+
+	for serverName, expected := range map[string]string{
+		"a.example.com":      "a",
+		"A.Example.com":      "a",
+		"www.b.example.com":  "b",
+		"b.example.com":      "default",
+		"deep.a.example.com": "default",
+	} {
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", addr)
+			},
+			TLSClientConfig: &tls.Config{
+				ServerName:         serverName,
+				InsecureSkipVerify: true, // #nosec The test servers' certificates are self-signed
+				MinVersion:         tls.VersionTLS12,
+			},
+		}}
+		status, body := getBody(t, client, "https://passthrough.example.com/")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, expected, body, "server name %#v", serverName)
+		client.CloseIdleConnections()
+	}
+}
+
+func TestPassthroughNotTLS(t *testing.T) {
+	t.Parallel()
+	s := poolService(t, []string{"-listen", ":443,passthrough"}, echoUpstream(t, "a"))
+	addr, _ := serveTCP(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	rest, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, rest, "connections that don't start with a TLS ClientHello get dropped")
+}
@@ -2,6 +2,7 @@ package tsnsrv
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -16,76 +17,128 @@ import (
 	"tailscale.com/client/tailscale/apitype"
 )
 
-type contextKey struct{}
+type contextKey struct{ name string }
 
-var proxyContextKey = contextKey{}
+var proxyContextKey = contextKey{"proxy"}
+var routeContextKey = contextKey{"route"}
 
 var (
-	requestDurations = promauto.NewSummary(prometheus.SummaryOpts{
+	requestDurations = promauto.NewSummaryVec(prometheus.SummaryOpts{
 		Name:       "tsnsrv_request_duration_ns",
 		Help:       "Duration of requests served",
 		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
-	})
+	}, []string{"service"})
 	responseStatusClasses = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "tsnsrv_response_status_classes",
 		Help: "Responses by status code class (1xx, etc)",
-	}, []string{"status_code_class"})
-	proxyErrors = promauto.NewCounter(prometheus.CounterOpts{
+	}, []string{"service", "status_code_class"})
+	proxyErrors = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "tsnsrv_proxy_errors",
 		Help: "Number of errors encountered proxying requests",
-	})
+	}, []string{"service"})
 )
 
 type proxyContext struct {
+	service      string
+	log          *slog.Logger
 	start        time.Time
+	remoteAddr   string
 	who          *apitype.WhoIsResponse
 	originalURL  *url.URL
 	rewrittenURL *url.URL
 }
 
-func (c *proxyContext) observeResponse(res *http.Response) {
+// observeResponse records the response in the service's metrics and
+// logs, with any extra attributes.
+func (c *proxyContext) observeResponse(res *http.Response, extra ...any) {
 	elapsed := time.Since(c.start)
-	requestDurations.Observe(float64(elapsed))
+	requestDurations.With(prometheus.Labels{"service": c.service}).Observe(float64(elapsed))
 
 	statusClass := fmt.Sprintf("%dxx", res.StatusCode/100)
-	responseStatusClasses.With(prometheus.Labels{"status_code_class": statusClass}).Inc()
+	responseStatusClasses.With(prometheus.Labels{"service": c.service, "status_code_class": statusClass}).Inc()
 
 	login := ""
 	node := ""
 	if c.who != nil {
 		login = c.who.UserProfile.LoginName
-		node = c.who.Node.Name
+		if c.who.Node != nil {
+			node = c.who.Node.Name
+		}
 	}
-	slog.Info("served",
+	attrs := []any{
 		"original", c.originalURL,
 		"rewritten", c.rewrittenURL,
 		"origin_login", login,
 		"origin_node", node,
 		"duration", elapsed,
 		"http_status", res.StatusCode,
-	)
+	}
+	if isGRPC(res) {
+		status := grpcStatus(res)
+		grpcStatuses.With(prometheus.Labels{"service": c.service, "grpc_status": status}).Inc()
+		attrs = append(attrs, "grpc_status", status)
+	}
+	c.log.Info("served", append(attrs, extra...)...)
+}
+
+// identity returns a key identifying the request's origin.
+func (c *proxyContext) identity() string {
+	return identityOf(c.who, c.remoteAddr)
+}
+
+// identityOf returns a key identifying a request's origin: The
+// requesting user, if known, or else their address.
+func identityOf(who *apitype.WhoIsResponse, remoteAddr string) string {
+	if who != nil {
+		return who.UserProfile.LoginName
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
 }
 
 func (s *ValidTailnetSrv) modifyResponse(res *http.Response) error {
 	p := res.Request.Context().Value(proxyContextKey).(*proxyContext)
-	if p != nil {
+	switch {
+	case p == nil:
+	case res.StatusCode == http.StatusSwitchingProtocols:
+		// Upgraded connections get observed when they're closed:
+		s.trackUpgraded(p, res)
+	case isGRPC(res):
+		// gRPC calls end (and report their status) with the trailers:
+		res.Body = &grpcBody{ReadCloser: res.Body, done: func() { p.observeResponse(res) }}
+	default:
 		p.observeResponse(res)
 	}
 	return nil
 }
 
 func (s *ValidTailnetSrv) errorHandler(rw http.ResponseWriter, _ *http.Request, err error) {
-	slog.Warn("proxy error",
+	s.log().Warn("proxy error",
 		"error", err,
 	)
-	proxyErrors.Inc()
+	proxyErrors.With(prometheus.Labels{"service": s.Name}).Inc()
+	if errors.Is(err, errNoUpstream) {
+		http.Error(rw, "503 Service Unavailable: "+s.Name+" is down right now, please try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	if tooLarge(err) {
+		http.Error(rw, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	rw.WriteHeader(http.StatusBadGateway)
 }
 
 func (s *ValidTailnetSrv) rewrite(r *httputil.ProxyRequest) {
-	r.SetURL(s.DestURL)
+	dest := s.DestURL
+	if route, ok := r.In.Context().Value(routeContextKey).(*prefix); ok && route.dest != nil {
+		dest = route.dest
+	}
+	r.SetURL(dest)
 	if r.In.URL.Path == "" {
-		r.Out.URL.Path = s.DestURL.Path
+		r.Out.URL.Path = dest.Path
 	}
 
 	r.SetXForwarded()
@@ -113,47 +166,49 @@ func (s *ValidTailnetSrv) rewrite(r *httputil.ProxyRequest) {
 		r.Out.Header[h] = vals
 	}
 
-	who := s.setWhoisHeaders(r)
+	who, _ := r.In.Context().Value(whoContextKey).(*apitype.WhoIsResponse)
+	if s.SuppressWhois {
+		setWhoisHeaders(r.Out.Header, nil)
+	} else {
+		setWhoisHeaders(r.Out.Header, who)
+		s.setGrantHeader(r.Out.Header, r.In)
+	}
+	s.setIdentityToken(r.Out.Header, who, dest)
 	r.Out = r.Out.WithContext(context.WithValue(r.Out.Context(), proxyContextKey, &proxyContext{
+		service:      s.Name,
+		log:          s.log(),
 		start:        time.Now(),
+		remoteAddr:   r.In.RemoteAddr,
 		originalURL:  r.In.URL,
 		rewrittenURL: r.Out.URL,
 		who:          who,
 	}))
 }
 
-// Clean up and set user/node identity headers:.
-func (s *ValidTailnetSrv) setWhoisHeaders(r *httputil.ProxyRequest) *apitype.WhoIsResponse {
+// Clean up and set user/node identity headers from who (as looked up by identify):.
+func setWhoisHeaders(h http.Header, who *apitype.WhoIsResponse) {
 	// First, clean out any input we received that looks like TS setting headers:
-	for k := range r.Out.Header {
+	for k := range h {
 		if strings.HasPrefix(k, "X-Tailscale-") {
-			r.Out.Header.Del(k)
+			h.Del(k)
 		}
 	}
-	if s.SuppressWhois || s.client == nil {
-		return nil
+	if who == nil {
+		return
 	}
 
-	ctx := r.In.Context()
-	if s.WhoisTimeout > 0 {
-		var cancel func()
-		ctx, cancel = context.WithTimeout(ctx, s.WhoisTimeout)
-		defer cancel()
+	if who.Node == nil {
+		// Users that authenticated on the funnel have no node, and
+		// their login names are namespaced with "funnel:".
+		h.Set("X-Tailscale-Funnel-User", "1")
 	}
-	who, err := s.client.WhoIs(ctx, r.In.RemoteAddr)
-	if err != nil {
-		slog.Warn("could not look up requestor identity",
-			"error", err,
-			"request", r.In,
-		)
-		return nil
+	if !who.UserProfile.ID.IsZero() {
+		h.Set("X-Tailscale-User", who.UserProfile.ID.String())
 	}
-	h := r.Out.Header
-	h.Set("X-Tailscale-User", who.UserProfile.ID.String())
 	login := who.UserProfile.LoginName
 	h.Set("X-Tailscale-User-LoginName", login)
 	ll, ld, splitable := strings.Cut(login, "@")
-	if splitable {
+	if splitable && who.Node != nil {
 		h.Set("X-Tailscale-User-LoginName-Localpart", ll)
 		h.Set("X-Tailscale-User-LoginName-Domain", ld)
 	}
@@ -169,6 +224,9 @@ func (s *ValidTailnetSrv) setWhoisHeaders(r *httputil.ProxyRequest) *apitype.Who
 		h.Set("X-Tailscale-Caps", strings.Join(caps, ", "))
 	}
 
+	if who.Node == nil {
+		return
+	}
 	h.Set("X-Tailscale-Node", who.Node.ID.String())
 	h.Set("X-Tailscale-Node-Name", who.Node.ComputedName)
 	if len(who.Node.CapMap) > 0 {
@@ -181,23 +239,36 @@ func (s *ValidTailnetSrv) setWhoisHeaders(r *httputil.ProxyRequest) *apitype.Who
 	if len(who.Node.Tags) > 0 {
 		h.Set("X-Tailscale-Node-Tags", strings.Join(who.Node.Tags, ", "))
 	}
-	return who
+}
+
+// setGrantHeader passes the -appCapability grants that cover the
+// request r on in h, as a JSON array of their values.
+func (s *ValidTailnetSrv) setGrantHeader(h http.Header, r *http.Request) {
+	grants, ok := r.Context().Value(grantsContextKey).([]appGrant)
+	if !ok {
+		return
+	}
+	encoded, err := grantsJSON(grants)
+	if err != nil {
+		s.log().Warn("could not pass app capability grants upstream", "error", err)
+		return
+	}
+	h.Set("X-Tailscale-App-Capability", encoded)
 }
 
 // matchPrefixes acts like the http.StripPrefix middleware, except
 // that it checks against several allowed prefixes (an empty list
 // means that all prefixes are allowed); if no prefixes match, it
-// returns 404.
+// returns 404. The first matching prefix is the request's route.
 func matchPrefixes(prefixes []prefix, strip bool, forFunnel bool, handler http.Handler) http.Handler {
 	if len(prefixes) == 0 {
 		return handler
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		for _, prefix := range prefixes {
-			if ok, stripData := prefix.matches(r.URL, forFunnel); ok {
-				r2 := new(http.Request)
-				*r2 = *r
-				if strip {
+			if ok, stripData := prefix.matches(r, forFunnel); ok {
+				r2 := r.WithContext(context.WithValue(r.Context(), routeContextKey, &prefix))
+				if prefix.strips(strip) {
 					r2.URL = new(url.URL)
 					*r2.URL = *r.URL
 					r2.URL.Path = stripData.path
@@ -216,7 +287,23 @@ func matchPrefixes(prefixes []prefix, strip bool, forFunnel bool, handler http.H
 	})
 }
 
+// handler returns the handler for requests arriving on the listener l.
+func (s *ValidTailnetSrv) handler(transport http.RoundTripper, l *listener) http.Handler {
+	if l.mode == listenRedirect {
+		return s.redirectHandler(s.srv.CertDomains)
+	}
+	allowed := s.AllowedPrefixes
+	if len(l.prefixes) > 0 {
+		allowed = l.prefixes
+	}
+	return s.prefixMux(transport, allowed, l.forFunnel())
+}
+
 func (s *ValidTailnetSrv) mux(transport http.RoundTripper, forFunnel bool) http.Handler {
+	return s.prefixMux(transport, s.AllowedPrefixes, forFunnel)
+}
+
+func (s *ValidTailnetSrv) prefixMux(transport http.RoundTripper, allowed prefixes, forFunnel bool) http.Handler {
 	proxy := &httputil.ReverseProxy{
 		Rewrite:        s.rewrite,
 		ModifyResponse: s.modifyResponse,
@@ -224,8 +311,11 @@ func (s *ValidTailnetSrv) mux(transport http.RoundTripper, forFunnel bool) http.
 		Transport:      transport,
 	}
 	mux := http.NewServeMux()
+	if s.OIDCPrefix != "" && !forFunnel {
+		mux.Handle(s.OIDCPrefix+"/", s.oidcProvider())
+	}
 
-	mux.Handle("/", matchPrefixes(s.AllowedPrefixes, s.StripPrefix, forFunnel, proxy))
+	mux.Handle("/", s.limitRequests(forFunnel, s.identify(forFunnel, s.authenticateFunnel(forFunnel, s.authorize(s.limitRate(forFunnel, s.verifyWebhooks(matchPrefixes(allowed, s.StripPrefix, forFunnel, s.forwardAuth(grpcWeb(s.limitUpgrades(proxy)))))))))))
 
 	return mux
 }
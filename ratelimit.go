@@ -0,0 +1,238 @@
+package tsnsrv
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var rateLimitDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_rate_limit_decisions",
+	Help: "Number of requests that -rateLimit rules let through (allowed) or answered with a 429 status (limited)",
+}, []string{"service", "path", "decision"})
+
+// rateLimitKey is what a rate limit keeps a separate token bucket for.
+type rateLimitKey int
+
+const (
+	rateLimitByLogin rateLimitKey = iota
+	rateLimitByNode
+	rateLimitByTag
+)
+
+var rateLimitKeyNames = map[rateLimitKey]string{
+	rateLimitByLogin: "login",
+	rateLimitByNode:  "node",
+	rateLimitByTag:   "tag",
+}
+
+// rateLimit is a token bucket rate limit on requests, optionally only
+// for requests under a path prefix. Each requestor on the tailnet
+// gets a bucket of their own, keyed by their login, node or tags;
+// requestors on the funnel (and any whose identity is unknown) get
+// one for their address.
+type rateLimit struct {
+	path  string
+	count int
+	per   time.Duration
+	burst int
+	by    rateLimitKey
+}
+
+var rateLimitUnits = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+func (l *rateLimit) String() string {
+	var unit string
+	for name, duration := range rateLimitUnits {
+		if duration == l.per {
+			unit = name
+		}
+	}
+	s := fmt.Sprintf("%d/%s,burst=%d,by=%s", l.count, unit, l.burst, rateLimitKeyNames[l.by])
+	if l.path != "" {
+		s = l.path + "=" + s
+	}
+	return s
+}
+
+// appliesTo returns whether the limit covers requests for path.
+func (l *rateLimit) appliesTo(path string) bool {
+	return pathHasPrefix(path, l.path)
+}
+
+// key returns the requestor's bucket key: who they are on the
+// tailnet, or their address on the funnel.
+func (l *rateLimit) key(who *apitype.WhoIsResponse, forFunnel bool, remoteAddr string) string {
+	switch {
+	case forFunnel || who == nil:
+		return "addr:" + identityOf(nil, remoteAddr)
+	case l.by == rateLimitByNode && who.Node != nil:
+		return "node:" + who.Node.Name
+	case l.by == rateLimitByTag && who.Node != nil && len(who.Node.Tags) > 0:
+		return "tags:" + strings.Join(who.Node.Tags, ",")
+	}
+	return "login:" + identityOf(who, remoteAddr)
+}
+
+type rateLimits []rateLimit
+
+func (ls *rateLimits) String() string {
+	var serialized []string
+	for _, l := range *ls {
+		serialized = append(serialized, l.String())
+	}
+	return strings.Join(serialized, " ")
+}
+
+var errRateLimitFormat = errors.New("rate limits must look like '[/path=]<requests>/s|m|h[,burst=<requests>][,by=login|node|tag]'")
+
+func (ls *rateLimits) Set(value string) error {
+	var l rateLimit
+	spec := value
+	if strings.HasPrefix(value, "/") {
+		var ok bool
+		l.path, spec, ok = strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("%w: missing rate in %#v", errRateLimitFormat, value)
+		}
+	}
+	options := strings.Split(spec, ",")
+	countStr, unit, _ := strings.Cut(options[0], "/")
+	count, err := strconv.Atoi(countStr)
+	per, ok := rateLimitUnits[unit]
+	if err != nil || count < 1 || !ok {
+		return fmt.Errorf("%w: invalid rate %#v", errRateLimitFormat, options[0])
+	}
+	l.count, l.per, l.burst = count, per, count
+	for _, option := range options[1:] {
+		name, optionValue, _ := strings.Cut(option, "=")
+		switch name {
+		case "burst":
+			l.burst, err = strconv.Atoi(optionValue)
+			if err != nil || l.burst < 1 {
+				return fmt.Errorf("%w: invalid burst %#v", errRateLimitFormat, optionValue)
+			}
+		case "by":
+			found := false
+			for key, keyName := range rateLimitKeyNames {
+				if keyName == optionValue {
+					l.by, found = key, true
+				}
+			}
+			if !found {
+				return fmt.Errorf("%w: invalid key %#v", errRateLimitFormat, optionValue)
+			}
+		default:
+			return fmt.Errorf("%w: unknown option %#v", errRateLimitFormat, option)
+		}
+	}
+	*ls = append(*ls, l)
+	return nil
+}
+
+// rateLimitSweepInterval is how often token buckets that filled up
+// again get forgotten.
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiters holds the token buckets of a service's rate limits. It
+// is shared by a service's configurations over reloads, so that
+// reloading doesn't refill buckets of limits that stay the same.
+type rateLimiters struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket // by rate limit and key
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	full    time.Time // when the bucket will have filled up again
+}
+
+// reserve takes a token from the bucket for l and key.
+func (rl *rateLimiters) reserve(l *rateLimit, key string, now time.Time) *rate.Reservation {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastSweep) > rateLimitSweepInterval {
+		// A full bucket is no different from a new one:
+		for id, b := range rl.buckets {
+			if now.After(b.full) {
+				delete(rl.buckets, id)
+			}
+		}
+		rl.lastSweep = now
+	}
+	if rl.buckets == nil {
+		rl.buckets = map[string]*bucket{}
+	}
+	id := l.String() + " " + key
+	b, ok := rl.buckets[id]
+	if !ok {
+		every := rate.Every(l.per / time.Duration(l.count))
+		b = &bucket{limiter: rate.NewLimiter(every, l.burst)}
+		rl.buckets[id] = b
+	}
+	reservation := b.limiter.ReserveN(now, 1)
+	missing := float64(l.burst) - b.limiter.TokensAt(now)
+	b.full = now.Add(time.Duration(missing * float64(l.per) / float64(l.count)))
+	return reservation
+}
+
+func (s *TailnetSrv) hasRateLimits() bool {
+	return len(s.RateLimits) > 0
+}
+
+// limitRate answers requests that exceed any -rateLimit covering
+// them with a 429 status, which tells clients when to retry. Requests
+// that get limited don't use up tokens of the other limits.
+func (s *ValidTailnetSrv) limitRate(forFunnel bool, next http.Handler) http.Handler {
+	if !s.hasRateLimits() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, _ := r.Context().Value(whoContextKey).(*apitype.WhoIsResponse)
+		now := time.Now()
+		var taken []*rate.Reservation
+		var allowed []prometheus.Labels
+		for i := range s.RateLimits {
+			l := &s.RateLimits[i]
+			if !l.appliesTo(r.URL.Path) {
+				continue
+			}
+			labels := prometheus.Labels{"service": s.Name, "path": cmp.Or(l.path, "/"), "decision": "allowed"}
+			key := l.key(who, forFunnel, r.RemoteAddr)
+			reservation := s.rateLimiters.reserve(l, key, now)
+			if delay := reservation.DelayFrom(now); delay > 0 {
+				for _, reservation := range append(taken, reservation) {
+					reservation.CancelAt(now)
+				}
+				s.log().Warn("Rate limited request",
+					"url", r.URL,
+					"key", key,
+					"limit", l,
+				)
+				labels["decision"] = "limited"
+				rateLimitDecisions.With(labels).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			taken = append(taken, reservation)
+			allowed = append(allowed, labels)
+		}
+		for _, labels := range allowed {
+			rateLimitDecisions.With(labels).Inc()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
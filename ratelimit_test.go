@@ -0,0 +1,105 @@
+package tsnsrv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func TestRateLimitFormat(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		value    string
+		expected string
+	}{
+		{"10/s", "10/s,burst=10,by=login"},
+		{"/api=600/m,burst=20", "/api=600/m,burst=20,by=login"},
+		{"100/h,by=tag", "100/h,burst=100,by=tag"},
+		{"5/s,by=node,burst=1", "5/s,burst=1,by=node"},
+		{"/api", ""},
+		{"10", ""},
+		{"0/s", ""},
+		{"10/d", ""},
+		{"10/s,burst=0", ""},
+		{"10/s,by=group", ""},
+		{"10/s,every=2", ""},
+	} {
+		test := elt
+		t.Run(test.value, func(t *testing.T) {
+			t.Parallel()
+			var limits rateLimits
+			err := limits.Set(test.value)
+			if test.expected == "" {
+				require.ErrorIs(t, err, errRateLimitFormat)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, limits.String())
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(),
+		"-rateLimit", "/api=2/h",
+		"-rateLimit", "3/h,by=tag",
+		"http://" + namedUpstream(t, "upstream"),
+	})
+	require.NoError(t, err)
+	var who atomic.Pointer[apitype.WhoIsResponse]
+	s.whois = func(context.Context, string) (*apitype.WhoIsResponse, error) { return who.Load(), nil }
+	tailnet := httptest.NewServer(s.mux(http.DefaultTransport, false))
+	t.Cleanup(tailnet.Close)
+	funnel := httptest.NewServer(s.mux(http.DefaultTransport, true))
+	t.Cleanup(funnel.Close)
+
+	limited := rateLimitDecisions.With(prometheus.Labels{"service": t.Name(), "path": "/api", "decision": "limited"})
+	limitedBefore := testutil.ToFloat64(limited)
+
+	get := func(proxy *httptest.Server, path string) *http.Response {
+		t.Helper()
+		resp, err := proxy.Client().Get(proxy.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	who.Store(whoIs("alice@example.com", "laptop"))
+	for range 2 {
+		assert.Equal(t, http.StatusOK, get(tailnet, "/api/").StatusCode)
+	}
+	resp := get(tailnet, "/api/")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1800", resp.Header.Get("Retry-After"), "a token comes back every half hour")
+	assert.Equal(t, http.StatusOK, get(tailnet, "/docs/").StatusCode, "limited requests don't use up tokens of other limits")
+	assert.Equal(t, http.StatusTooManyRequests, get(tailnet, "/docs/").StatusCode)
+
+	who.Store(whoIs("bob@example.com", "desktop"))
+	for range 2 {
+		assert.Equal(t, http.StatusOK, get(tailnet, "/api/").StatusCode, "other users have buckets of their own")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, get(tailnet, "/api/").StatusCode)
+	assert.Equal(t, http.StatusOK, get(tailnet, "/apis").StatusCode, "/api doesn't cover /apis")
+
+	who.Store(whoIs("tagged-devices", "ci-1", "tag:ci"))
+	for range 3 {
+		assert.Equal(t, http.StatusOK, get(tailnet, "/docs/").StatusCode)
+	}
+	who.Store(whoIs("tagged-devices", "ci-2", "tag:ci"))
+	assert.Equal(t, http.StatusTooManyRequests, get(tailnet, "/docs/").StatusCode, "nodes with the same tags share their bucket")
+
+	assert.Equal(t, http.StatusOK, get(funnel, "/api/").StatusCode, "funnel requests are limited by address")
+	assert.Equal(t, http.StatusOK, get(funnel, "/api/").StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, get(funnel, "/api/").StatusCode)
+
+	assert.InDelta(t, 3, testutil.ToFloat64(limited)-limitedBefore, 0)
+}
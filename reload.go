@@ -0,0 +1,247 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// handlerSwitch is an http.Handler (or connHandler) that passes
+// requests (or connections) on to a handler that can be replaced at
+// any time. Requests that are in flight keep using the handler that
+// they started out with.
+type handlerSwitch struct {
+	handler atomic.Pointer[http.Handler]
+	conns   atomic.Pointer[connHandler]
+}
+
+func (hs *handlerSwitch) Store(h http.Handler) {
+	hs.handler.Store(&h)
+}
+
+func (hs *handlerSwitch) StoreConns(h connHandler) {
+	hs.conns.Store(&h)
+}
+
+func (hs *handlerSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*hs.handler.Load()).ServeHTTP(w, r)
+}
+
+func (hs *handlerSwitch) ServeConn(conn net.Conn) {
+	(*hs.conns.Load()).ServeConn(conn)
+}
+
+// restartSettings are the settings of a service that only take
+// effect when its node and listeners get set up, so they can't be
+// changed by reloading the config. Each field is tagged with the
+// name of the flag that sets it.
+type restartSettings struct {
+	Name              string        `flag:"name"`
+	StateDir          string        `flag:"stateDir"`
+	AuthkeyPath       string        `flag:"authkeyPath"`
+	Tags              string        `flag:"tag"`
+	ListenAddr        string        `flag:"listenAddr"`
+	Listeners         string        `flag:"listen"`
+	CertificateFile   string        `flag:"certificateFile"`
+	KeyFile           string        `flag:"keyFile"`
+	SNICertificates   string        `flag:"sniCertificate"`
+	ClientCAFile      string        `flag:"clientCAFile"`
+	RequireClientCert bool          `flag:"requireClientCertificate"`
+	Ephemeral         bool          `flag:"ephemeral"`
+	Funnel            bool          `flag:"funnel"`
+	FunnelOnly        bool          `flag:"funnelOnly"`
+	ServePlaintext    bool          `flag:"plaintext"`
+	TsnetVerbose      bool          `flag:"tsnetVerbose"`
+	Timeout           time.Duration `flag:"timeout"`
+	ReadHeaderTimeout time.Duration `flag:"readHeaderTimeout"`
+	ShutdownTimeout   time.Duration `flag:"shutdownTimeout"`
+	FunnelLimits      string        `flag:"funnelLimits"`
+	TailnetLimits     string        `flag:"tailnetLimits"`
+}
+
+func (s *TailnetSrv) restartSettings() restartSettings {
+	return restartSettings{
+		Name:              s.Name,
+		StateDir:          s.StateDir,
+		AuthkeyPath:       s.AuthkeyPath,
+		Tags:              s.Tags.String(),
+		ListenAddr:        s.ListenAddr,
+		Listeners:         s.Listeners.endpoints(),
+		CertificateFile:   s.certificateFile,
+		KeyFile:           s.keyFile,
+		SNICertificates:   s.SNICertificates.String(),
+		ClientCAFile:      s.ClientCAFile,
+		RequireClientCert: s.RequireClientCertificate,
+		Ephemeral:         s.Ephemeral,
+		Funnel:            s.Funnel,
+		FunnelOnly:        s.FunnelOnly,
+		ServePlaintext:    s.ServePlaintext,
+		TsnetVerbose:      s.TsnetVerbose,
+		Timeout:           s.Timeout,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ShutdownTimeout:   s.ShutdownTimeout,
+		FunnelLimits:      s.FunnelLimits.serverSettings(),
+		TailnetLimits:     s.TailnetLimits.serverSettings(),
+	}
+}
+
+// changed returns the flag names of the settings that differ between rs and other.
+func (rs restartSettings) changed(other restartSettings) []string {
+	var changed []string
+	a, b := reflect.ValueOf(rs), reflect.ValueOf(other)
+	for i := range a.NumField() {
+		if !a.Field(i).Equal(b.Field(i)) {
+			changed = append(changed, a.Type().Field(i).Tag.Get("flag"))
+		}
+	}
+	return changed
+}
+
+var errNoConfigFile = errors.New("services were not read from a config file")
+var errNotRunning = errors.New("service is not running yet")
+var errNeedsRestart = errors.New("changed settings need a restart")
+
+// Reload re-reads the config file that the services were read from,
+// and switches the running services over to the new routing, upstream
+// and header settings without reconnecting them to the tailnet.
+//
+// If the new config is invalid, or changes anything that requires a
+// restart (like adding or removing services, or changing their
+// names, listeners or tailnet settings), Reload returns an error and
+// the services keep running with their previous config.
+func (ss *Services) Reload() error {
+	if ss.configPath == "" {
+		return errNoConfigFile
+	}
+	contents, err := os.ReadFile(ss.configPath)
+	if err != nil {
+		return fmt.Errorf("reading config file %#v: %w", ss.configPath, err)
+	}
+	return ss.reloadFrom(contents)
+}
+
+func (ss *Services) reloadFrom(contents []byte) error {
+	next, err := servicesFromConfigContents(ss.configPath, contents)
+	if err != nil {
+		return err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var errs []error
+	if next.PrometheusAddr != ss.PrometheusAddr || next.EnableBugReports != ss.EnableBugReports {
+		errs = append(errs, fmt.Errorf("%w: prometheusAddr, enableBugReports", errNeedsRestart))
+	}
+	names := func(services []*ValidTailnetSrv) []string {
+		var names []string
+		for _, s := range services {
+			names = append(names, s.Name)
+		}
+		return names
+	}
+	if !slices.Equal(names(next.Services), names(ss.Services)) {
+		errs = append(errs, fmt.Errorf("%w: services changed from %v to %v",
+			errNeedsRestart, names(ss.Services), names(next.Services)))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	for i, s := range next.Services {
+		if err := ss.Services[i].canReloadAs(s); err != nil {
+			errs = append(errs, fmt.Errorf("service %v: %w", s.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// Prepare all the services before switching any of them over, so
+	// that either all of them run with the new config, or none do:
+	installs := make([]func(), len(next.Services))
+	for i, s := range next.Services {
+		old := ss.Services[i]
+		s.srv, s.client, s.whois = old.srv, old.client, old.whois
+		s.handlers, s.upgrades, s.requests, s.rateLimiters = old.handlers, old.upgrades, old.requests, old.rateLimiters
+		s.oidcGrants = old.oidcGrants
+		// Funnel users stay logged in, and the identity key stays the
+		// same over reloads:
+		s.sessionKey = old.sessionKey
+		if s.signsTokens() {
+			s.identityKey = old.identityKey
+		}
+		install, err := s.prepare()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %v: %w", s.Name, err))
+			continue
+		}
+		installs[i] = install
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for i, s := range next.Services {
+		old := ss.Services[i]
+		installs[i]()
+		old.transport.Close()
+		ss.Services[i] = s
+		s.log().Info("Reloaded config",
+			"prefixes", s.AllowedPrefixes,
+			"destURL", s.DestURL,
+		)
+	}
+	return nil
+}
+
+// canReloadAs returns an error if s can not switch over to the
+// settings in next while running.
+func (s *ValidTailnetSrv) canReloadAs(next *ValidTailnetSrv) error {
+	if s.handlers == nil {
+		return errNotRunning
+	}
+	if changed := s.restartSettings().changed(next.restartSettings()); len(changed) > 0 {
+		return fmt.Errorf("%w: %v", errNeedsRestart, strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// configPollInterval is how often a config file is checked for changes.
+var configPollInterval = 2 * time.Second
+
+// watchConfig reloads the services whenever their config file's
+// contents change, until ctx is done.
+func (ss *Services) watchConfig(ctx context.Context) {
+	last, err := os.ReadFile(ss.configPath)
+	if err != nil {
+		slog.Warn("Could not read config file to watch for changes", "path", ss.configPath, "error", err)
+	}
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		contents, err := os.ReadFile(ss.configPath)
+		if err != nil || bytes.Equal(contents, last) {
+			continue
+		}
+		last = contents
+		slog.Info("Config file changed, reloading", "path", ss.configPath)
+		if err := ss.reloadFrom(contents); err != nil {
+			slog.Error("Could not reload config file, keeping the previous config", "path", ss.configPath, "error", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package tsnsrv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+	upstream := func(body string) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(body))
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	first, second := upstream("first"), upstream("second")
+	config := func(extra, toURL string) string {
+		return "stateDir: /tmp\nservices: [{name: foo, suppressTailnetDialer: true" + extra + ", toURL: " + toURL + "}]\n"
+	}
+	configPath := writeConfig(t, "tsnsrv.yaml", config("", first.URL))
+	services, err := ServicesFromConfigFile(configPath)
+	require.NoError(t, err)
+	// Pretend the service is running:
+	for _, s := range services.Services {
+		require.NoError(t, s.activate())
+	}
+	proxy := httptest.NewServer(services.Services[0].handlers[0])
+	t.Cleanup(proxy.Close)
+	assertServedBy := func(expected string) {
+		t.Helper()
+		resp, err := proxy.Client().Get(proxy.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(body))
+	}
+	assertServedBy("first")
+
+	require.NoError(t, os.WriteFile(configPath, []byte(config("", second.URL)), 0o600))
+	require.NoError(t, services.Reload())
+	assertServedBy("second")
+
+	// Invalid configs keep the previous one active:
+	require.NoError(t, os.WriteFile(configPath, []byte(config("", "::--example.com")), 0o600))
+	require.Error(t, services.Reload())
+	assertServedBy("second")
+
+	require.NoError(t, os.WriteFile(configPath, []byte(config(", funnel: true", first.URL)), 0o600))
+	require.ErrorIs(t, services.Reload(), errNeedsRestart)
+	assertServedBy("second")
+
+	require.NoError(t, os.WriteFile(configPath, []byte("stateDir: /tmp\nservices: [{name: bar, toURL: "+first.URL+"}]\n"), 0o600))
+	require.ErrorIs(t, services.Reload(), errNeedsRestart)
+	assertServedBy("second")
+}
+
+func TestReloadAllOrNothing(t *testing.T) {
+	t.Parallel()
+	first, second := namedUpstream(t, "first"), namedUpstream(t, "second")
+	config := func(fooURL, barExtra string) string {
+		return "stateDir: /tmp\nservices:\n" +
+			"  - {name: foo, suppressTailnetDialer: true, toURL: http://" + fooURL + "}\n" +
+			"  - {name: bar, suppressTailnetDialer: true, toURL: http://" + first + barExtra + "}\n"
+	}
+	configPath := writeConfig(t, "tsnsrv.yaml", config(first, ""))
+	services, err := ServicesFromConfigFile(configPath)
+	require.NoError(t, err)
+	for _, s := range services.Services {
+		require.NoError(t, s.activate())
+	}
+	foo := services.Services[0]
+	proxy := httptest.NewServer(foo.handlers[0])
+	t.Cleanup(proxy.Close)
+
+	// bar can't switch over (it has no tailscale client to check the
+	// rule with), so foo must not either:
+	require.NoError(t, os.WriteFile(configPath, []byte(config(second, ", allow: [tag:ci]")), 0o600))
+	require.ErrorIs(t, services.Reload(), errAccessRulesNeedClient)
+	assert.Same(t, foo, services.Services[0])
+	status, body := getBody(t, proxy.Client(), proxy.URL)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "first", body)
+}
+
+func TestReloadWithoutConfigFile(t *testing.T) {
+	t.Parallel()
+	services, _, err := ServicesFromArgs([]string{"tsnsrv", "-name", "foo", "http://example.com"})
+	require.NoError(t, err)
+	require.ErrorIs(t, services.Reload(), errNoConfigFile)
+}
@@ -0,0 +1,298 @@
+package tsnsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var (
+	connectionDurations = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "tsnsrv_connection_duration_ns",
+		Help:       "Duration of forwarded connections, UDP flows and upgraded HTTP connections",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	}, []string{"service", "mode"})
+	connectionBytes = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "tsnsrv_connection_bytes",
+		Help:       "Bytes forwarded per connection, UDP flow or upgraded HTTP connection, by direction (in from the client, or out to it)",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	}, []string{"service", "mode", "direction"})
+	activeConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_connections_active",
+		Help: "Number of connections, UDP flows and upgraded HTTP connections being forwarded",
+	}, []string{"service", "mode"})
+	connectionErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsnsrv_connection_errors",
+		Help: "Number of connections and UDP flows that could not be forwarded",
+	}, []string{"service", "mode"})
+)
+
+// connHandler handles the connections that a listener accepts, the
+// way an http.Handler handles requests.
+type connHandler interface {
+	ServeConn(conn net.Conn)
+}
+
+// connServer serves the connections arriving on a listener with a
+// connHandler, and shuts down gracefully like an http.Server does.
+type connServer struct {
+	handler connHandler
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	done     sync.WaitGroup
+}
+
+func (cs *connServer) Serve(l net.Listener) error {
+	cs.mu.Lock()
+	if cs.closed {
+		cs.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	cs.listener = l
+	cs.conns = map[net.Conn]struct{}{}
+	cs.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			cs.mu.Lock()
+			closed := cs.closed
+			cs.mu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return fmt.Errorf("accepting connections: %w", err)
+		}
+		cs.mu.Lock()
+		if cs.closed {
+			// Shutdown may be waiting for the others already:
+			cs.mu.Unlock()
+			conn.Close()
+			return net.ErrClosed
+		}
+		cs.conns[conn] = struct{}{}
+		cs.done.Add(1)
+		cs.mu.Unlock()
+		go func() {
+			defer cs.done.Done()
+			defer func() {
+				cs.mu.Lock()
+				delete(cs.conns, conn)
+				cs.mu.Unlock()
+			}()
+			cs.handler.ServeConn(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections, and waits for the ones in
+// flight to finish until ctx is done. Then, it closes them.
+func (cs *connServer) Shutdown(ctx context.Context) error {
+	cs.mu.Lock()
+	cs.closed = true
+	if cs.listener != nil {
+		cs.listener.Close()
+	}
+	cs.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		cs.done.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		for conn := range cs.conns {
+			conn.Close()
+		}
+		return fmt.Errorf("closing %d connections in flight: %w", len(cs.conns), ctx.Err())
+	}
+}
+
+// forwarder passes the connections (or UDP flows) that tcp, udp and
+// passthrough listeners accept on to the service's upstream
+// addresses. Passthrough connections go where the router sends them.
+type forwarder struct {
+	s      *ValidTailnetSrv
+	pool   *upstreamPool
+	router *sniRouter
+	mode   listenerMode
+}
+
+// lookupWho returns who is on the other end of conn, or nil if that's
+// unknown; if the lookup failed, it also returns an error.
+func (s *ValidTailnetSrv) lookupWho(conn net.Conn) (*apitype.WhoIsResponse, error) {
+	if s.whois == nil {
+		return nil, nil
+	}
+	ctx := context.Background()
+	if s.WhoisTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, s.WhoisTimeout)
+		defer cancel()
+	}
+	who, err := s.whois(ctx, conn.RemoteAddr().String())
+	if err != nil {
+		s.log().Warn("could not look up requestor identity",
+			"error", err,
+			"remoteAddr", conn.RemoteAddr(),
+		)
+		return nil, fmt.Errorf("%w: %w", errIdentityUnknown, err)
+	}
+	return who, nil
+}
+
+// dialUpstream connects to one of the pool's upstream addresses,
+// trying the others if that fails.
+func (p *upstreamPool) dialUpstream(ctx context.Context, identity, network, addr string) (net.Conn, *upstreamEndpoint, error) {
+	tried := map[*upstreamEndpoint]bool{}
+	var errs []error
+	for {
+		e := p.pick(identity, tried)
+		if e == nil {
+			return nil, nil, errors.Join(append(errs, errNoUpstream)...)
+		}
+		tried[e] = true
+		conn, err := e.dial(ctx, network, addr)
+		p.observe(e, err != nil)
+		if err == nil {
+			return conn, e, nil
+		}
+		errs = append(errs, err)
+	}
+}
+
+func (f *forwarder) ServeConn(conn net.Conn) {
+	s := f.s
+	defer conn.Close()
+	start := time.Now()
+	labels := prometheus.Labels{"service": s.Name, "mode": f.mode.String()}
+	activeConnections.With(labels).Inc()
+	defer activeConnections.With(labels).Dec()
+
+	who, whoErr := s.lookupWho(conn)
+	login, node := "", ""
+	if who != nil {
+		login, node = who.UserProfile.LoginName, who.Node.Name
+	}
+	log := s.log().With(
+		"remoteAddr", conn.RemoteAddr(),
+		"origin_login", login,
+		"origin_node", node,
+	)
+	if s.hasAccessRules() {
+		err := whoErr
+		if err == nil {
+			err = s.checkAccess(who, s.appConnGrants(who), "")
+		}
+		if err != nil {
+			log.Warn("Denied connection", "reason", err)
+			accessDenied.With(prometheus.Labels{"service": s.Name}).Inc()
+			return
+		}
+	}
+	identity := login
+	if who == nil {
+		identity, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	}
+	network := "tcp"
+	if f.mode == listenUDP {
+		network = "udp"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	pool := f.pool
+	if f.mode == listenPassthrough {
+		serverName, replay, err := readServerName(ctx, conn)
+		if err != nil {
+			log.Warn("Could not route connection", "error", err)
+			connectionErrors.With(labels).Inc()
+			return
+		}
+		conn = replay
+		pool = f.router.route(serverName)
+		log = log.With("server_name", serverName)
+	}
+	upstream, e, err := pool.dialUpstream(ctx, identity, network, s.destAddr())
+	cancel()
+	if err != nil {
+		log.Warn("Could not connect upstream", "error", err)
+		connectionErrors.With(labels).Inc()
+		return
+	}
+	defer upstream.Close()
+	defer pool.track(e)()
+
+	var in, out int64
+	if f.mode == listenUDP {
+		in, out = relayDatagrams(conn, upstream, s.UDPIdleTimeout)
+	} else {
+		in, out = splice(conn, upstream)
+	}
+	elapsed := time.Since(start)
+	connectionDurations.With(labels).Observe(float64(elapsed))
+	connectionBytes.With(prometheus.Labels{"service": s.Name, "mode": f.mode.String(), "direction": "in"}).Observe(float64(in))
+	connectionBytes.With(prometheus.Labels{"service": s.Name, "mode": f.mode.String(), "direction": "out"}).Observe(float64(out))
+	log.Info("served connection",
+		"upstream", e.name,
+		"bytes_in", in,
+		"bytes_out", out,
+		"duration", elapsed,
+	)
+}
+
+// appConnGrants returns the -appCapability grants that cover whole
+// connections: the ones that don't restrict paths or methods.
+func (s *ValidTailnetSrv) appConnGrants(who *apitype.WhoIsResponse) []appGrant {
+	var grants []appGrant
+	for _, grant := range s.parseGrants(who) {
+		if grant.covers("", "") {
+			grants = append(grants, grant)
+		}
+	}
+	return grants
+}
+
+// closeWriter is implemented by connections that can be half-closed.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies data between client and upstream in both directions
+// until both are done, and returns the number of bytes that went in
+// from the client, and out to it.
+func splice(client, upstream net.Conn) (int64, int64) {
+	var in, out atomic.Int64
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn, n *atomic.Int64) {
+		defer wg.Done()
+		written, _ := io.Copy(dst, src)
+		n.Store(written)
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Add(2)
+	go copyHalf(upstream, client, &in)
+	go copyHalf(client, upstream, &out)
+	wg.Wait()
+	return in.Load(), out.Load()
+}
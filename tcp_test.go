@@ -0,0 +1,189 @@
+package tsnsrv
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// echoUpstream returns the address of a TCP server that echoes each
+// line it receives, prefixed with name.
+func echoUpstream(t *testing.T, name string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					_, _ = io.WriteString(conn, name+": "+scanner.Text()+"\n")
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serveTCP starts forwarding connections as s's first listener does,
+// and returns the address to connect to.
+func serveTCP(t *testing.T, s *ValidTailnetSrv) (string, *connServer) {
+	t.Helper()
+	require.NoError(t, s.activate())
+	t.Cleanup(s.transport.Close)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := s.newServer(s.Listeners[0], s.handlers[0]).(*connServer)
+	go func() { _ = server.Serve(l) }()
+	t.Cleanup(func() { _ = server.Shutdown(context.Background()) })
+	return l.Addr().String(), server
+}
+
+func TestTCPForwarding(t *testing.T) {
+	t.Parallel()
+	s := poolService(t, []string{"-listen", ":5432,tcp"}, echoUpstream(t, "a"), echoUpstream(t, "b"))
+	addr, _ := serveTCP(t, s)
+
+	seen := map[string]bool{}
+	for range 2 {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		_, err = io.WriteString(conn, "hello\n")
+		require.NoError(t, err)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		seen[line] = true
+		conn.Close()
+	}
+	assert.Equal(t, map[string]bool{"a: hello\n": true, "b: hello\n": true}, seen)
+}
+
+func TestTCPGracefulShutdown(t *testing.T) {
+	t.Parallel()
+	s := poolService(t, []string{"-listen", ":5432,tcp"}, echoUpstream(t, "a"))
+	addr, server := serveTCP(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_, err = io.WriteString(conn, "before\n")
+	require.NoError(t, err)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	shutdownResult := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownResult <- server.Shutdown(ctx)
+	}()
+
+	// Connections in flight keep working until they're done:
+	_, err = io.WriteString(conn, "during\n")
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "a: during\n", line)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	_, err = reader.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF)
+	require.NoError(t, <-shutdownResult)
+
+	// ...but new ones don't get in:
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+}
+
+// slowListener is a net.Listener that accepts its conns only when
+// the test sends them, even after it's closed.
+type slowListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *slowListener) Accept() (net.Conn, error) { return <-l.conns, nil }
+func (l *slowListener) Close() error              { return nil }
+
+type connHandlerFunc func(net.Conn)
+
+func (f connHandlerFunc) ServeConn(conn net.Conn) { f(conn) }
+
+func TestTCPAcceptDuringShutdown(t *testing.T) {
+	t.Parallel()
+	handled := make(chan struct{}, 1)
+	server := &connServer{handler: connHandlerFunc(func(net.Conn) { handled <- struct{}{} })}
+	l := &slowListener{conns: make(chan net.Conn)}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+	require.Eventually(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.listener != nil
+	}, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, server.Shutdown(t.Context()))
+	client, conn := net.Pipe()
+	defer client.Close()
+	l.conns <- conn
+	select {
+	case err := <-served:
+		require.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "Serve keeps going after Shutdown")
+	}
+	assert.Empty(t, handled, "connections accepted during shutdown aren't handled")
+	_, err := client.Write([]byte("hello"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe, "...but closed")
+}
+
+func TestTCPAccessControl(t *testing.T) {
+	t.Parallel()
+	s := poolService(t, []string{"-listen", ":5432,tcp", "-deny", "tag:untrusted"}, echoUpstream(t, "a"))
+	s.whois = func(context.Context, string) (*apitype.WhoIsResponse, error) {
+		return whoIs("tagged-devices", "sketchy", "tag:untrusted"), nil
+	}
+	addr, _ := serveTCP(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "hello\n")
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestTCPAccessControlLookupFailure(t *testing.T) {
+	t.Parallel()
+	s := poolService(t, []string{"-listen", ":5432,tcp", "-deny", "tag:untrusted"}, echoUpstream(t, "a"))
+	s.whois = func(context.Context, string) (*apitype.WhoIsResponse, error) {
+		return nil, context.DeadlineExceeded
+	}
+	addr, _ := serveTCP(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "hello\n")
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF, "connections from unknown requestors don't get through -deny rules")
+}
+
+func TestTCPListenerPrefixes(t *testing.T) {
+	t.Parallel()
+	_, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-listen", ":5432,tcp,prefix=/foo", "tcp://127.0.0.1:5432"})
+	require.ErrorIs(t, err, errPrefixesNeedHTTP)
+}
@@ -0,0 +1,265 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var droppedDatagrams = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_udp_dropped_datagrams",
+	Help: "Number of datagrams from clients that were dropped because their flow could not keep up",
+}, []string{"service"})
+
+// maxDatagramSize is the largest UDP payload that can be relayed.
+const maxDatagramSize = 65535
+
+// flowQueueLength is how many datagrams from a client can wait for
+// their flow to pass them on before any more get dropped.
+const flowQueueLength = 64
+
+// flowConn is a net.Conn for the datagrams that one client sends to
+// a UDP listener: Each Read returns one datagram, and each Write
+// sends one back.
+type flowConn struct {
+	pc        net.PacketConn
+	peer      net.Addr
+	datagrams chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFlowConn(pc net.PacketConn, peer net.Addr) *flowConn {
+	return &flowConn{
+		pc:        pc,
+		peer:      peer,
+		datagrams: make(chan []byte, flowQueueLength),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (f *flowConn) Read(b []byte) (int, error) {
+	select {
+	case datagram := <-f.datagrams:
+		return copy(b, datagram), nil
+	case <-f.closed:
+		return 0, io.EOF
+	}
+}
+
+func (f *flowConn) Write(b []byte) (int, error) {
+	select {
+	case <-f.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	n, err := f.pc.WriteTo(b, f.peer)
+	if err != nil {
+		return n, fmt.Errorf("sending datagram to %v: %w", f.peer, err)
+	}
+	return n, nil
+}
+
+func (f *flowConn) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *flowConn) LocalAddr() net.Addr  { return f.pc.LocalAddr() }
+func (f *flowConn) RemoteAddr() net.Addr { return f.peer }
+
+// Flows time out on their own, so they don't support deadlines:
+
+func (f *flowConn) SetDeadline(time.Time) error      { return nil }
+func (f *flowConn) SetReadDeadline(time.Time) error  { return nil }
+func (f *flowConn) SetWriteDeadline(time.Time) error { return nil }
+
+// packetServer tracks the flows of datagrams arriving on UDP
+// listeners, and hands each of them to a connHandler. It shuts down
+// gracefully, like connServer does.
+type packetServer struct {
+	handler connHandler
+	service string
+
+	mu     sync.Mutex
+	pcs    []net.PacketConn
+	flows  map[string]*flowConn
+	closed bool
+	done   sync.WaitGroup
+}
+
+// ServePacket relays the datagrams arriving on pc, until the server
+// gets shut down.
+func (ps *packetServer) ServePacket(pc net.PacketConn) error {
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		pc.Close()
+		return net.ErrClosed
+	}
+	ps.pcs = append(ps.pcs, pc)
+	if ps.flows == nil {
+		ps.flows = map[string]*flowConn{}
+	}
+	ps.mu.Unlock()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, peer, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return net.ErrClosed
+			}
+			return fmt.Errorf("receiving datagrams: %w", err)
+		}
+		flow := ps.flow(pc, peer)
+		if flow == nil {
+			continue
+		}
+		select {
+		case flow.datagrams <- bytes.Clone(buf[:n]):
+		default:
+			droppedDatagrams.With(prometheus.Labels{"service": ps.service}).Inc()
+		}
+	}
+}
+
+// flow returns the flow of datagrams from peer on pc, starting a new
+// one unless the server is shutting down.
+func (ps *packetServer) flow(pc net.PacketConn, peer net.Addr) *flowConn {
+	key := pc.LocalAddr().String() + "," + peer.String()
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if flow, ok := ps.flows[key]; ok {
+		return flow
+	}
+	if ps.closed {
+		return nil
+	}
+	flow := newFlowConn(pc, peer)
+	ps.flows[key] = flow
+	ps.done.Add(1)
+	go func() {
+		defer ps.done.Done()
+		defer func() {
+			ps.mu.Lock()
+			delete(ps.flows, key)
+			ps.mu.Unlock()
+		}()
+		ps.handler.ServeConn(flow)
+	}()
+	return flow
+}
+
+// Shutdown stops accepting new flows, and waits for the ones in
+// flight to finish (or time out) until ctx is done. Then, it closes
+// them, and stops listening.
+func (ps *packetServer) Shutdown(ctx context.Context) error {
+	ps.mu.Lock()
+	ps.closed = true
+	ps.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		ps.done.Wait()
+		close(finished)
+	}()
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		ps.mu.Lock()
+		for _, flow := range ps.flows {
+			flow.Close()
+		}
+		err = fmt.Errorf("closing %d flows in flight: %w", len(ps.flows), ctx.Err())
+		ps.mu.Unlock()
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, pc := range ps.pcs {
+		pc.Close()
+	}
+	return err
+}
+
+// listenPackets relays the datagrams arriving at the UDP listener l.
+// Without an IP address, it listens on all of the node's tailnet
+// addresses.
+func (s *ValidTailnetSrv) listenPackets(server *packetServer, l listener) error {
+	server.service = s.Name
+	host, port, err := net.SplitHostPort(l.addr)
+	if err != nil {
+		return fmt.Errorf("invalid UDP listener address %#v: %w", l.addr, err)
+	}
+	addrs := []string{l.addr}
+	if host == "" {
+		addrs = nil
+		ip4, ip6 := s.srv.TailscaleIPs()
+		for _, ip := range []netip.Addr{ip4, ip6} {
+			if ip.IsValid() {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+			}
+		}
+	}
+	results := make(chan error, len(addrs))
+	var opened []net.PacketConn
+	for _, addr := range addrs {
+		pc, err := s.srv.ListenPacket("udp", addr)
+		if err != nil {
+			for _, pc := range opened {
+				pc.Close()
+			}
+			return fmt.Errorf("creating UDP listener on the tailnet: %w", err)
+		}
+		opened = append(opened, pc)
+		go func() { results <- server.ServePacket(pc) }()
+	}
+	return <-results
+}
+
+// relayDatagrams passes datagrams between the client's flow and the
+// upstream, until neither sent any for idleTimeout. It returns the
+// number of bytes that went in from the client, and out to it.
+func relayDatagrams(client, upstream net.Conn, idleTimeout time.Duration) (int64, int64) {
+	var in, out atomic.Int64
+	idle := time.AfterFunc(idleTimeout, func() {
+		client.Close()
+		upstream.Close()
+	})
+	defer idle.Stop()
+	relay := func(dst, src net.Conn, n *atomic.Int64) {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			read, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			idle.Reset(idleTimeout)
+			if _, err := dst.Write(buf[:read]); err != nil {
+				return
+			}
+			n.Add(int64(read))
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		relay(client, upstream, &out)
+	}()
+	relay(upstream, client, &in)
+	upstream.Close()
+	wg.Wait()
+	return in.Load(), out.Load()
+}
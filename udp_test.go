@@ -0,0 +1,115 @@
+package tsnsrv
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// udpEchoUpstream returns the address of a UDP server that answers
+// each datagram with name and the datagram's contents.
+func udpEchoUpstream(t *testing.T, name string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, peer, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(append([]byte(name+": "), buf[:n]...), peer)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// serveUDP starts relaying datagrams as s's first listener does, and
+// returns the address to send them to.
+func serveUDP(t *testing.T, s *ValidTailnetSrv) (string, *packetServer) {
+	t.Helper()
+	require.NoError(t, s.activate())
+	t.Cleanup(s.transport.Close)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := s.newServer(s.Listeners[0], s.handlers[0]).(*packetServer)
+	go func() { _ = server.ServePacket(pc) }()
+	t.Cleanup(func() { _ = server.Shutdown(context.Background()) })
+	return pc.LocalAddr().String(), server
+}
+
+func exchange(t *testing.T, conn net.Conn, datagram string) string {
+	t.Helper()
+	_, err := conn.Write([]byte(datagram))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, maxDatagramSize)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestUDPForwarding(t *testing.T) {
+	t.Parallel()
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-suppressTailnetDialer",
+		"-listen", ":53,udp",
+		"-udpIdleTimeout", "1s",
+		"-upstream", "tcp:" + udpEchoUpstream(t, "a"),
+		"-upstream", "tcp:" + udpEchoUpstream(t, "b"),
+		"udp://dns",
+	})
+	require.NoError(t, err)
+	addr, _ := serveUDP(t, s)
+
+	// Each client's datagrams make up a flow that stays on one upstream:
+	seen := map[string]bool{}
+	for range 2 {
+		conn, err := net.Dial("udp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		first := exchange(t, conn, "hello")
+		seen[first] = true
+		assert.Equal(t, first[:1]+": again", exchange(t, conn, "again"))
+	}
+	assert.Equal(t, map[string]bool{"a: hello": true, "b: hello": true}, seen)
+}
+
+func TestUDPIdleTimeout(t *testing.T) {
+	t.Parallel()
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-suppressTailnetDialer",
+		"-listen", ":53,udp",
+		"-udpIdleTimeout", "50ms",
+		"udp://" + udpEchoUpstream(t, "a"),
+	})
+	require.NoError(t, err)
+	addr, server := serveUDP(t, s)
+
+	conn, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "a: hello", exchange(t, conn, "hello"))
+	require.Eventually(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.flows) == 0
+	}, 5*time.Second, 10*time.Millisecond, "the idle flow should end")
+
+	// A new flow starts when the client sends more:
+	assert.Equal(t, "a: again", exchange(t, conn, "again"))
+}
+
+func TestUDPListeners(t *testing.T) {
+	t.Parallel()
+	_, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-listen", ":53,tcp", "-listen", ":53,udp", "udp://127.0.0.1:53"})
+	require.NoError(t, err, "tcp and udp listeners can share an address")
+	_, _, err = TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-listen", ":53,udp", "-listen", ":53,udp", "udp://127.0.0.1:53"})
+	require.ErrorIs(t, err, errDuplicateListener)
+	_, _, err = TailnetSrvFromArgs([]string{"tsnsrv", "-name", "foo", "-listen", ":53,udp", "-upstream", "unix:/run/dns.sock", "udp://127.0.0.1:53"})
+	require.ErrorIs(t, err, errUDPNeedsNetworkUpstream)
+}
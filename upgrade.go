@@ -0,0 +1,168 @@
+package tsnsrv
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var upgradesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_upgrades_rejected",
+	Help: "Number of requests to upgrade connections (e.g. to WebSocket) that were rejected because their requestor had too many already",
+}, []string{"service"})
+
+// isUpgrade returns whether r asks to switch protocols, e.g. to WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for token := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// openCounts tracks how many upgraded connections (or requests in
+// flight) each identity has open. It is shared by a service's
+// configurations over reloads.
+type openCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// acquire counts another open connection for identity, unless it
+// has limit of them already (and limit is not 0).
+func (u *openCounts) acquire(identity string, limit int) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if limit > 0 && u.counts[identity] >= limit {
+		return false
+	}
+	if u.counts == nil {
+		u.counts = map[string]int{}
+	}
+	u.counts[identity]++
+	return true
+}
+
+func (u *openCounts) release(identity string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.counts[identity]--
+	if u.counts[identity] <= 0 {
+		delete(u.counts, identity)
+	}
+}
+
+// limitUpgrades rejects requests to upgrade connections from
+// requestors that have -maxUpgradesPerIdentity of them open. The
+// reverse proxy serves upgraded connections until they're closed,
+// so they count for as long as handler runs.
+func (s *ValidTailnetSrv) limitUpgrades(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgrade(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		who, _ := r.Context().Value(whoContextKey).(*apitype.WhoIsResponse)
+		identity := identityOf(who, r.RemoteAddr)
+		if !s.upgrades.acquire(identity, s.MaxUpgradesPerIdentity) {
+			s.log().Warn("Too many upgraded connections",
+				"identity", identity,
+				"limit", s.MaxUpgradesPerIdentity,
+			)
+			upgradesRejected.With(prometheus.Labels{"service": s.Name}).Inc()
+			http.Error(w, "429 Too Many Requests: too many open connections", http.StatusTooManyRequests)
+			return
+		}
+		defer s.upgrades.release(identity)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// upgradedConn is the upstream end of an upgraded connection. It
+// tracks the connection until it gets closed, which happens once it
+// was idle for the service's -upgradeIdleTimeout.
+type upgradedConn struct {
+	io.ReadWriteCloser
+	in, out atomic.Int64
+	idle    *time.Timer
+	timeout time.Duration
+	once    sync.Once
+	done    func(in, out int64)
+}
+
+// trackUpgraded makes the upgraded connection in res's body report
+// its bytes and duration once it's closed, and counts it as active
+// until then.
+func (s *ValidTailnetSrv) trackUpgraded(p *proxyContext, res *http.Response) {
+	backConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+	labels := prometheus.Labels{"service": s.Name, "mode": "upgrade"}
+	activeConnections.With(labels).Inc()
+	start := time.Now()
+	conn := &upgradedConn{ReadWriteCloser: backConn, timeout: s.UpgradeIdleTimeout}
+	conn.done = func(in, out int64) {
+		activeConnections.With(labels).Dec()
+		connectionDurations.With(labels).Observe(float64(time.Since(start)))
+		connectionBytes.With(prometheus.Labels{"service": s.Name, "mode": "upgrade", "direction": "in"}).Observe(float64(in))
+		connectionBytes.With(prometheus.Labels{"service": s.Name, "mode": "upgrade", "direction": "out"}).Observe(float64(out))
+		p.observeResponse(res, "bytes_in", in, "bytes_out", out)
+	}
+	if conn.timeout > 0 {
+		conn.idle = time.AfterFunc(conn.timeout, func() { conn.Close() })
+	}
+	res.Body = conn
+}
+
+// active notes that data went through the connection.
+func (c *upgradedConn) active() {
+	if c.idle != nil {
+		c.idle.Reset(c.timeout)
+	}
+}
+
+func (c *upgradedConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if n > 0 {
+		c.out.Add(int64(n))
+		c.active()
+	}
+	return n, err //nolint:wrapcheck // passed through like the connection's own errors
+}
+
+func (c *upgradedConn) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	if n > 0 {
+		c.in.Add(int64(n))
+		c.active()
+	}
+	return n, err //nolint:wrapcheck // passed through like the connection's own errors
+}
+
+// Close stops the idle timer, closes the connection, and reports it.
+// Closing it again does nothing.
+func (c *upgradedConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		if c.idle != nil {
+			c.idle.Stop()
+		}
+		err = c.ReadWriteCloser.Close()
+		c.done(c.in.Load(), c.out.Load())
+	})
+	return err //nolint:wrapcheck // passed through like the connection's own errors
+}
@@ -0,0 +1,132 @@
+package tsnsrv
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upgradeUpstream returns an upstream server that upgrades
+// connections to a protocol that echoes each line sent to it.
+func upgradeUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = rw.Flush()
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			_, _ = rw.WriteString(line)
+			_ = rw.Flush()
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// upgrade opens a connection to addr and asks to upgrade it, returning
+// the response and a reader for the rest of the connection.
+func upgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = io.WriteString(conn, "GET /echo HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	return conn, reader, resp
+}
+
+func upgradedService(t *testing.T, extra ...string) string {
+	t.Helper()
+	args := append([]string{"tsnsrv", "-name", t.Name()}, extra...)
+	s, _, err := TailnetSrvFromArgs(append(args, upgradeUpstream(t).URL))
+	require.NoError(t, err)
+	proxy := httptest.NewServer(s.mux(http.DefaultTransport, false))
+	t.Cleanup(proxy.Close)
+	return proxy.Listener.Addr().String()
+}
+
+func TestUpgradeLimit(t *testing.T) {
+	t.Parallel()
+	addr := upgradedService(t, "-maxUpgradesPerIdentity", "1")
+
+	conn, reader, resp := upgrade(t, addr)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	_, err := io.WriteString(conn, "hello\n")
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+
+	_, _, resp = upgrade(t, addr)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "only one upgraded connection at a time")
+
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		conn, _, resp := upgrade(t, addr)
+		defer conn.Close()
+		return resp.StatusCode == http.StatusSwitchingProtocols
+	}, 5*time.Second, 10*time.Millisecond, "closed connections don't count")
+}
+
+// countingCloser counts how often it gets closed.
+type countingCloser struct {
+	io.ReadWriter
+	closed atomic.Int32
+}
+
+func (c *countingCloser) Close() error {
+	c.closed.Add(1)
+	return nil
+}
+
+func TestUpgradedConnClose(t *testing.T) {
+	t.Parallel()
+	backConn := &countingCloser{}
+	var reported atomic.Int32
+	conn := &upgradedConn{ReadWriteCloser: backConn, timeout: 10 * time.Millisecond, done: func(int64, int64) { reported.Add(1) }}
+	conn.idle = time.AfterFunc(conn.timeout, func() { conn.Close() })
+
+	require.NoError(t, conn.Close())
+	require.NoError(t, conn.Close())
+	assert.False(t, conn.idle.Stop(), "closing stops the idle timer")
+	time.Sleep(5 * conn.timeout)
+	assert.Equal(t, int32(1), backConn.closed.Load())
+	assert.Equal(t, int32(1), reported.Load())
+}
+
+func TestUpgradeIdleTimeout(t *testing.T) {
+	t.Parallel()
+	addr := upgradedService(t, "-upgradeIdleTimeout", "100ms")
+
+	conn, reader, resp := upgrade(t, addr)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	for range 3 {
+		time.Sleep(50 * time.Millisecond)
+		_, err := io.WriteString(conn, "still here\n")
+		require.NoError(t, err)
+		_, err = reader.ReadString('\n')
+		require.NoError(t, err, "active connections stay open")
+	}
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err := reader.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF, "idle connections get closed")
+}
@@ -0,0 +1,481 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	upstreamEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsnsrv_upstream_ejections",
+		Help: "Number of times an upstream address was ejected from its pool after failing repeatedly",
+	}, []string{"service", "upstream"})
+	upstreamInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_upstream_requests_in_flight",
+		Help: "Requests in flight to each upstream address",
+	}, []string{"service", "upstream"})
+)
+
+type upstreamKind int
+
+const (
+	upstreamTCP upstreamKind = iota
+	upstreamUnix
+	upstreamTailnet
+)
+
+var upstreamKindNames = map[upstreamKind]string{
+	upstreamTCP:     "tcp",
+	upstreamUnix:    "unix",
+	upstreamTailnet: "tailnet",
+}
+
+// upstreamAddr is an address that upstream requests can be sent to.
+type upstreamAddr struct {
+	kind upstreamKind
+	addr string
+}
+
+func (u upstreamAddr) String() string {
+	return upstreamKindNames[u.kind] + ":" + u.addr
+}
+
+type upstreamAddrs []upstreamAddr
+
+func (u *upstreamAddrs) String() string {
+	var serialized []string
+	for _, addr := range *u {
+		serialized = append(serialized, addr.String())
+	}
+	return strings.Join(serialized, ", ")
+}
+
+var errUpstreamFormat = errors.New("upstream addresses must look like 'tcp:<host:port>', 'unix:<path>' or 'tailnet:<host:port>'")
+
+func (u *upstreamAddrs) Set(value string) error {
+	kindName, addr, ok := strings.Cut(value, ":")
+	if !ok || addr == "" {
+		return fmt.Errorf("%w: %#v", errUpstreamFormat, value)
+	}
+	for kind, name := range upstreamKindNames {
+		if name == kindName {
+			*u = append(*u, upstreamAddr{kind, addr})
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %#v", errUpstreamFormat, value)
+}
+
+type balancePolicy int
+
+const (
+	balanceRoundRobin balancePolicy = iota
+	balanceLeastConnections
+	balanceIdentityHash
+)
+
+var balancePolicyNames = map[balancePolicy]string{
+	balanceRoundRobin:       "roundRobin",
+	balanceLeastConnections: "leastConnections",
+	balanceIdentityHash:     "identityHash",
+}
+
+func (p *balancePolicy) String() string {
+	return balancePolicyNames[*p]
+}
+
+var errBalancePolicy = errors.New("upstream policy must be one of roundRobin, leastConnections or identityHash")
+
+func (p *balancePolicy) Set(value string) error {
+	for policy, name := range balancePolicyNames {
+		if name == value {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %#v", errBalancePolicy, value)
+}
+
+type upstreamProtocol int
+
+const (
+	protocolHTTP1 upstreamProtocol = iota
+	protocolH2C
+	protocolH2
+)
+
+var upstreamProtocolNames = map[upstreamProtocol]string{
+	protocolHTTP1: "http1",
+	protocolH2C:   "h2c",
+	protocolH2:    "h2",
+}
+
+func (p *upstreamProtocol) String() string {
+	return upstreamProtocolNames[*p]
+}
+
+var errUpstreamProtocol = errors.New("upstream protocol must be one of http1, h2c or h2")
+
+func (p *upstreamProtocol) Set(value string) error {
+	for protocol, name := range upstreamProtocolNames {
+		if name == value {
+			*p = protocol
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %#v", errUpstreamProtocol, value)
+}
+
+// scheme returns the URL scheme that upstream requests need to use
+// for the protocol, or "" if either will do.
+func (p upstreamProtocol) scheme() string {
+	switch p {
+	case protocolH2C:
+		return "http"
+	case protocolH2:
+		return "https"
+	case protocolHTTP1:
+	}
+	return ""
+}
+
+// protocols returns the protocols that an http.Transport should
+// speak, or nil for its defaults.
+func (p upstreamProtocol) protocols() *http.Protocols {
+	var protocols http.Protocols
+	switch p {
+	case protocolH2C:
+		protocols.SetUnencryptedHTTP2(true)
+	case protocolH2:
+		protocols.SetHTTP2(true)
+	case protocolHTTP1:
+		return nil
+	}
+	return &protocols
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialError marks errors that happened before a request could be
+// sent, so that it is safe to retry the request elsewhere.
+type dialError struct{ error }
+
+func (e dialError) Unwrap() error { return e.error }
+
+// upstreamEndpoint is one address in an upstream pool.
+type upstreamEndpoint struct {
+	name      string
+	dial      dialFunc
+	transport *http.Transport
+	inFlight  atomic.Int64
+	healthy   atomic.Bool
+
+	mu           sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+}
+
+// available returns whether the endpoint can take requests at now.
+func (e *upstreamEndpoint) available(now time.Time) bool {
+	if !e.healthy.Load() {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !now.Before(e.ejectedUntil)
+}
+
+// upstreamPool is a RoundTripper that balances requests across a
+// service's upstream addresses. Addresses that fail several times in
+// a row get ejected from the pool for a while, and addresses that
+// fail their health checks get skipped until they pass them again.
+type upstreamPool struct {
+	service       string
+	policy        balancePolicy
+	ejectAfter    int
+	ejectFor      time.Duration
+	ejectOnStatus bool
+	endpoints     []*upstreamEndpoint
+	next          atomic.Uint64
+	stopChecks    context.CancelFunc
+}
+
+// dialer returns the dial function that reaches addr. It connects
+// over TCP (or to the Unix domain socket), unless the caller asks for
+// UDP.
+func (s *ValidTailnetSrv) dialer(addr upstreamAddr) dialFunc {
+	var dial dialFunc
+	switch addr.kind {
+	case upstreamTCP:
+		dial = s.srv.Dial
+		if s.SuppressTailnetDialer {
+			d := net.Dialer{}
+			dial = d.DialContext
+		}
+	case upstreamTailnet:
+		dial = s.srv.Dial
+	case upstreamUnix:
+		d := net.Dialer{}
+		dial = d.DialContext
+	}
+	stream := "tcp"
+	if addr.kind == upstreamUnix {
+		stream = "unix"
+	}
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		if network != "udp" {
+			network = stream
+		}
+		conn, err := dial(ctx, network, addr.addr)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to %v: %w", addr, err)
+		}
+		return conn, nil
+	}
+}
+
+// upstreamAddrs returns the addresses that requests can go to; if
+// there are none, requests go to the hosts in their URLs.
+func (s *TailnetSrv) upstreamAddrs() upstreamAddrs {
+	switch {
+	case s.UpstreamTCPAddr != "":
+		return upstreamAddrs{{upstreamTCP, s.UpstreamTCPAddr}}
+	case s.UpstreamUnixAddr != "":
+		return upstreamAddrs{{upstreamUnix, s.UpstreamUnixAddr}}
+	}
+	return s.Upstreams
+}
+
+// destAddr returns the host and port of the destination URL, which
+// connections go to if the service has no upstream addresses.
+func (s *ValidTailnetSrv) destAddr() string {
+	if s.DestURL.Port() != "" {
+		return s.DestURL.Host
+	}
+	port := "80"
+	if s.DestURL.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(s.DestURL.Hostname(), port)
+}
+
+// newPool returns a pool of the service's upstream addresses, each
+// with a transport that newTransport builds.
+func (s *ValidTailnetSrv) newPool(newTransport func(dial dialFunc) *http.Transport) *upstreamPool {
+	addrs := s.upstreamAddrs()
+	pool := s.addrPool(addrs, newTransport)
+	if len(addrs) == 0 {
+		dial := s.srv.Dial
+		if s.SuppressTailnetDialer {
+			d := net.Dialer{}
+			dial = d.DialContext
+		}
+		pool.add("url", dial, newTransport)
+	}
+	return pool
+}
+
+// addrPool returns a pool of the given upstream addresses, balanced
+// according to the service's settings.
+func (s *ValidTailnetSrv) addrPool(addrs upstreamAddrs, newTransport func(dial dialFunc) *http.Transport) *upstreamPool {
+	pool := &upstreamPool{
+		service:       s.Name,
+		policy:        s.UpstreamPolicy,
+		ejectAfter:    s.UpstreamEjectAfter,
+		ejectFor:      s.UpstreamEjectFor,
+		ejectOnStatus: s.UpstreamEjectOnStatus,
+	}
+	for _, addr := range addrs {
+		pool.add(addr.String(), s.dialer(addr), newTransport)
+	}
+	return pool
+}
+
+func (p *upstreamPool) add(name string, dial dialFunc, newTransport func(dial dialFunc) *http.Transport) {
+	endpoint := &upstreamEndpoint{name: name}
+	endpoint.healthy.Store(true)
+	endpoint.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, dialError{err}
+		}
+		return conn, nil
+	}
+	endpoint.transport = newTransport(endpoint.dial)
+	p.endpoints = append(p.endpoints, endpoint)
+}
+
+// Close stops the pool's health checks and closes the idle
+// connections to all upstream addresses.
+func (p *upstreamPool) Close() {
+	if p.stopChecks != nil {
+		p.stopChecks()
+	}
+	for _, e := range p.endpoints {
+		e.transport.CloseIdleConnections()
+	}
+}
+
+// pick chooses the endpoint that a request with the given identity
+// should go to, skipping the ones that were already tried.
+func (p *upstreamPool) pick(identity string, tried map[*upstreamEndpoint]bool) *upstreamEndpoint {
+	now := time.Now()
+	var candidates []*upstreamEndpoint
+	for _, e := range p.endpoints {
+		if !tried[e] && e.available(now) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 && len(tried) == 0 {
+		// Everything healthy is ejected; better to try than to fail outright:
+		for _, e := range p.endpoints {
+			if e.healthy.Load() {
+				candidates = append(candidates, e)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.policy {
+	case balanceLeastConnections:
+		best := candidates[0]
+		for _, e := range candidates[1:] {
+			if e.inFlight.Load() < best.inFlight.Load() {
+				best = e
+			}
+		}
+		return best
+	case balanceIdentityHash:
+		// Rendezvous hashing keeps identities on the same address
+		// while the set of available addresses changes.
+		var best *upstreamEndpoint
+		var bestScore uint64
+		for _, e := range candidates {
+			sum := sha256.Sum256([]byte(identity + "\x00" + e.name))
+			if score := binary.BigEndian.Uint64(sum[:8]); best == nil || score > bestScore {
+				best, bestScore = e, score
+			}
+		}
+		return best
+	case balanceRoundRobin:
+	}
+	return candidates[p.next.Add(1)%uint64(len(candidates))]
+}
+
+// observe records the outcome of a request to e, ejecting it if it
+// failed too many times in a row.
+func (p *upstreamPool) observe(e *upstreamEndpoint, failed bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !failed {
+		e.failures = 0
+		return
+	}
+	e.failures++
+	if p.ejectAfter > 0 && e.failures >= p.ejectAfter {
+		e.failures = 0
+		e.ejectedUntil = time.Now().Add(p.ejectFor)
+		upstreamEjections.With(prometheus.Labels{"service": p.service, "upstream": e.name}).Inc()
+		if len(p.endpoints) > 1 {
+			serviceLog(p.service).Warn("Ejecting failing upstream", "upstream", e.name, "until", e.ejectedUntil)
+		}
+	}
+}
+
+func (p *upstreamPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	identity := ""
+	if pc, ok := req.Context().Value(proxyContextKey).(*proxyContext); ok {
+		identity = pc.identity()
+	}
+	tried := map[*upstreamEndpoint]bool{}
+	var dialErr error
+	for {
+		e := p.pick(identity, tried)
+		if e == nil && dialErr != nil {
+			return nil, fmt.Errorf("%w: %w", errNoUpstream, dialErr)
+		}
+		if e == nil {
+			return nil, errNoUpstream
+		}
+		tried[e] = true
+		done := p.track(e)
+
+		res, err := e.transport.RoundTrip(req)
+		if err != nil {
+			done()
+			p.observe(e, true)
+			// Requests that never made it to the upstream can go elsewhere:
+			if errors.As(err, &dialError{}) && (req.Body == nil || req.Body == http.NoBody) {
+				dialErr = err
+				continue
+			}
+			return nil, err
+		}
+		// The upstream service answered, so it only failed if it says
+		// so (and the service counts that as failing):
+		p.observe(e, p.ejectOnStatus && (res.StatusCode == http.StatusBadGateway ||
+			res.StatusCode == http.StatusServiceUnavailable ||
+			res.StatusCode == http.StatusGatewayTimeout))
+		res.Body = onClose(res.Body, done)
+		return res, nil
+	}
+}
+
+var errNoUpstream = errors.New("no upstream address is available")
+
+// track counts a request (or connection) to e as in flight, until
+// the returned function gets called.
+func (p *upstreamPool) track(e *upstreamEndpoint) func() {
+	inFlight := upstreamInFlight.With(prometheus.Labels{"service": p.service, "upstream": e.name})
+	e.inFlight.Add(1)
+	inFlight.Inc()
+	return func() {
+		e.inFlight.Add(-1)
+		inFlight.Dec()
+	}
+}
+
+// onClose wraps body so that done gets called once it is closed,
+// keeping it writable if it was (as for upgraded connections).
+func onClose(body io.ReadCloser, done func()) io.ReadCloser {
+	var once sync.Once
+	closer := closeNotifier{body, func() { once.Do(done) }}
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return readWriteCloseNotifier{closer, rwc}
+	}
+	return closer
+}
+
+type closeNotifier struct {
+	io.ReadCloser
+	done func()
+}
+
+func (c closeNotifier) Close() error {
+	defer c.done()
+	return c.ReadCloser.Close() //nolint:wrapcheck // Passing on the body's error.
+}
+
+type readWriteCloseNotifier struct {
+	closeNotifier
+	w io.Writer
+}
+
+func (c readWriteCloseNotifier) Write(p []byte) (int, error) {
+	return c.w.Write(p) //nolint:wrapcheck // Passing on the connection's error.
+}
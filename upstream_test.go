@@ -0,0 +1,203 @@
+package tsnsrv
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamFlags(t *testing.T) {
+	for _, elt := range []struct {
+		name string
+		args []string
+		ok   bool
+	}{
+		{"pool", []string{"-upstream", "tcp:127.0.0.1:8000", "-upstream", "unix:/run/app.sock", "-upstream", "tailnet:app-2:8000"}, true},
+		{"policy", []string{"-upstream", "tcp:127.0.0.1:8000", "-upstreamPolicy", "identityHash"}, true},
+
+		// Expected to fail:
+		{"with upstreamTCPAddr", []string{"-upstream", "tcp:127.0.0.1:8000", "-upstreamTCPAddr", "127.0.0.1:8001"}, false},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			args := append([]string{"tsnsrv", "-name", "foo"}, test.args...)
+			_, _, err := TailnetSrvFromArgs(append(args, "http://example.com"))
+			if test.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestUpstreamFormat(t *testing.T) {
+	t.Parallel()
+	var addrs upstreamAddrs
+	require.NoError(t, addrs.Set("tcp:127.0.0.1:8000"))
+	require.NoError(t, addrs.Set("unix:/run/app.sock"))
+	require.NoError(t, addrs.Set("tailnet:app-2:8000"))
+	assert.Equal(t, "tcp:127.0.0.1:8000, unix:/run/app.sock, tailnet:app-2:8000", addrs.String())
+	assert.ErrorIs(t, addrs.Set("udp:127.0.0.1:8000"), errUpstreamFormat)
+	assert.ErrorIs(t, addrs.Set("tcp:"), errUpstreamFormat)
+
+	var policy balancePolicy
+	require.NoError(t, policy.Set("leastConnections"))
+	assert.Equal(t, balanceLeastConnections, policy)
+	assert.ErrorIs(t, policy.Set("random"), errBalancePolicy)
+}
+
+// poolService returns a service that balances requests across the
+// given upstream addresses.
+func poolService(t *testing.T, extra []string, addrs ...string) *ValidTailnetSrv {
+	t.Helper()
+	args := []string{"tsnsrv", "-name", t.Name(), "-suppressTailnetDialer"}
+	for _, addr := range addrs {
+		args = append(args, "-upstream", "tcp:"+addr)
+	}
+	s, _, err := TailnetSrvFromArgs(append(append(args, extra...), "http://app.example.com"))
+	require.NoError(t, err)
+	return s
+}
+
+func namedUpstream(t *testing.T, name string) string {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+func deadUpstream(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	return addr
+}
+
+func getBody(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	t.Parallel()
+	s := poolService(t, nil, namedUpstream(t, "a"), namedUpstream(t, "b"))
+	proxy := httptest.NewServer(s.mux(s.newTransport(), false))
+	t.Cleanup(proxy.Close)
+
+	seen := map[string]int{}
+	for range 4 {
+		status, body := getBody(t, proxy.Client(), proxy.URL)
+		require.Equal(t, http.StatusOK, status)
+		seen[body]++
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, seen)
+}
+
+func TestUpstreamEjection(t *testing.T) {
+	t.Parallel()
+	s := poolService(t, []string{"-upstreamEjectAfter", "1"}, deadUpstream(t), namedUpstream(t, "alive"))
+	pool := s.newTransport()
+	proxy := httptest.NewServer(s.mux(pool, false))
+	t.Cleanup(proxy.Close)
+
+	// Requests that can't reach an upstream get retried on the others:
+	for range 3 {
+		status, body := getBody(t, proxy.Client(), proxy.URL)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "alive", body)
+	}
+	assert.False(t, pool.endpoints[0].available(time.Now()), "the unreachable upstream should be ejected")
+}
+
+func TestUpstreamEjectOnStatus(t *testing.T) {
+	t.Parallel()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(unavailable.Close)
+	addr := unavailable.Listener.Addr().String()
+
+	for _, elt := range []struct {
+		name    string
+		args    []string
+		ejected bool
+	}{
+		{"by default", nil, false},
+		{"with -upstreamEjectOnStatus", []string{"-upstreamEjectOnStatus"}, true},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			s := poolService(t, append([]string{"-upstreamEjectAfter", "1"}, test.args...), addr, namedUpstream(t, "alive"))
+			pool := s.newTransport()
+			proxy := httptest.NewServer(s.mux(pool, false))
+			t.Cleanup(proxy.Close)
+
+			for range 2 {
+				getBody(t, proxy.Client(), proxy.URL)
+			}
+			assert.Equal(t, !test.ejected, pool.endpoints[0].available(time.Now()))
+		})
+	}
+}
+
+func TestUpstreamNoneAvailable(t *testing.T) {
+	t.Parallel()
+	s := poolService(t, nil, deadUpstream(t), deadUpstream(t))
+	proxy := httptest.NewServer(s.mux(s.newTransport(), false))
+	t.Cleanup(proxy.Close)
+
+	status, _ := getBody(t, proxy.Client(), proxy.URL)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "http://example.com/", nil)
+	require.NoError(t, err)
+	transport := s.newTransport()
+	t.Cleanup(transport.Close)
+	_, err = transport.RoundTrip(req)
+	require.ErrorIs(t, err, errNoUpstream)
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED, "the cause of the last failure gets reported")
+}
+
+func TestUpstreamIdentityHash(t *testing.T) {
+	t.Parallel()
+	s := poolService(t, []string{"-upstreamPolicy", "identityHash"},
+		"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3")
+	pool := s.newTransport()
+
+	spread := map[*upstreamEndpoint]bool{}
+	for i := range 20 {
+		identity := fmt.Sprintf("user%d@example.com", i)
+		picked := pool.pick(identity, map[*upstreamEndpoint]bool{})
+		assert.Same(t, picked, pool.pick(identity, map[*upstreamEndpoint]bool{}))
+		spread[picked] = true
+
+		// Identities stay put unless their address goes away:
+		other := pool.endpoints[0]
+		if other == picked {
+			other = pool.endpoints[1]
+		}
+		assert.Same(t, picked, pool.pick(identity, map[*upstreamEndpoint]bool{other: true}),
+			"identity %v moved when %v went away", identity, other.name)
+	}
+	assert.Len(t, spread, 3, "identities should spread across all addresses")
+}
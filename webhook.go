@@ -0,0 +1,310 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var webhookVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_webhook_verifications",
+	Help: "Number of requests to -webhook paths whose signature was valid, invalid, or too old (expired)",
+}, []string{"service", "path", "result"})
+
+// webhookStyle is how a webhook sender signs its requests.
+type webhookStyle int
+
+const (
+	// GitHub signs the body, in the X-Hub-Signature-256 header.
+	webhookGitHub webhookStyle = iota
+	// GitLab doesn't sign anything, but sends the secret in the
+	// X-Gitlab-Token header.
+	webhookGitLab
+	// Stripe signs the timestamp and body, in the Stripe-Signature
+	// header.
+	webhookStripe
+	// Slack signs the timestamp and body, in the X-Slack-Signature
+	// and X-Slack-Request-Timestamp headers.
+	webhookSlack
+	// Generic HMAC-SHA256 signatures of the body (or of the timestamp
+	// and body, if the webhook has a timestamp header).
+	webhookHMAC
+)
+
+var webhookStyleNames = map[webhookStyle]string{
+	webhookGitHub: "github",
+	webhookGitLab: "gitlab",
+	webhookStripe: "stripe",
+	webhookSlack:  "slack",
+	webhookHMAC:   "hmac",
+}
+
+// defaultWebhookMaxAge is how old the timestamps of signed requests
+// can be, unless a -webhook says otherwise.
+const defaultWebhookMaxAge = 5 * time.Minute
+
+// webhookMaxBody is the largest request body that tsnsrv reads to
+// verify its signature, unless -funnelLimits or -tailnetLimits'
+// maxBody is lower. (It's also the largest payload GitHub sends.)
+const webhookMaxBody = 25 << 20
+
+// webhook makes requests under a path prefix prove that they come
+// from a webhook sender, by signing them with a shared secret.
+type webhook struct {
+	path            string
+	style           webhookStyle
+	secretFile      string
+	header          string // the signature, for hmac webhooks
+	timestampHeader string // the signed timestamp, for hmac webhooks
+	maxAge          time.Duration
+}
+
+func (h *webhook) String() string {
+	s := h.path + "=" + webhookStyleNames[h.style] + ":" + h.secretFile
+	if h.style == webhookHMAC {
+		s += ",header=" + h.header
+		if h.timestampHeader != "" {
+			s += ",timestampHeader=" + h.timestampHeader
+		}
+	}
+	if h.maxAge != defaultWebhookMaxAge {
+		s += ",maxAge=" + h.maxAge.String()
+	}
+	return s
+}
+
+type webhooks []webhook
+
+func (hs *webhooks) String() string {
+	var serialized []string
+	for _, h := range *hs {
+		serialized = append(serialized, h.String())
+	}
+	return strings.Join(serialized, " ")
+}
+
+var errWebhookFormat = errors.New("webhooks must look like '/path=github|gitlab|stripe|slack|hmac:<secret file>[,maxAge=<duration>]', and hmac ones can add ',header=<name>' and ',timestampHeader=<name>'")
+
+func (hs *webhooks) Set(value string) error {
+	path, spec, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%w: missing path in %#v", errWebhookFormat, value)
+	}
+	h := webhook{path: path, header: "X-Signature", maxAge: defaultWebhookMaxAge}
+	options := strings.Split(spec, ",")
+	styleName, secretFile, _ := strings.Cut(options[0], ":")
+	found := false
+	for style, name := range webhookStyleNames {
+		if name == styleName {
+			h.style, found = style, true
+		}
+	}
+	if !found || secretFile == "" {
+		return fmt.Errorf("%w: invalid style or secret file %#v", errWebhookFormat, options[0])
+	}
+	h.secretFile = secretFile
+	for _, option := range options[1:] {
+		name, optionValue, _ := strings.Cut(option, "=")
+		switch {
+		case name == "maxAge":
+			maxAge, err := time.ParseDuration(optionValue)
+			if err != nil || maxAge <= 0 {
+				return fmt.Errorf("%w: invalid maxAge %#v", errWebhookFormat, optionValue)
+			}
+			h.maxAge = maxAge
+		case name == "header" && h.style == webhookHMAC && optionValue != "":
+			h.header = http.CanonicalHeaderKey(optionValue)
+		case name == "timestampHeader" && h.style == webhookHMAC && optionValue != "":
+			h.timestampHeader = http.CanonicalHeaderKey(optionValue)
+		default:
+			return fmt.Errorf("%w: unknown option %#v", errWebhookFormat, option)
+		}
+	}
+	*hs = append(*hs, h)
+	return nil
+}
+
+// appliesTo returns whether the webhook covers requests for path.
+func (h *webhook) appliesTo(path string) bool {
+	return pathHasPrefix(path, h.path)
+}
+
+var errWebhookSecretEmpty = errors.New("webhook secret file is empty")
+var errWebhookSignature = errors.New("missing or invalid webhook signature")
+var errWebhookExpired = errors.New("webhook timestamp is too old")
+
+// verify returns an error unless the request with header and body is
+// signed with secret (and, for styles that sign a timestamp, was
+// signed within the webhook's maxAge of now).
+func (h *webhook) verify(secret []byte, header http.Header, body []byte, now time.Time) error {
+	switch h.style {
+	case webhookGitHub:
+		signature, _ := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+		return checkSignature(secret, signature, body)
+	case webhookGitLab:
+		if subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), secret) != 1 {
+			return errWebhookSignature
+		}
+		return nil
+	case webhookStripe:
+		var timestamp string
+		var signatures []string
+		for field := range strings.SplitSeq(header.Get("Stripe-Signature"), ",") {
+			name, value, _ := strings.Cut(field, "=")
+			switch name {
+			case "t":
+				timestamp = value
+			case "v1":
+				signatures = append(signatures, value)
+			}
+		}
+		if err := h.checkTimestamp(timestamp, now); err != nil {
+			return err
+		}
+		message := append([]byte(timestamp+"."), body...)
+		for _, signature := range signatures {
+			if checkSignature(secret, signature, message) == nil {
+				return nil
+			}
+		}
+		return errWebhookSignature
+	case webhookSlack:
+		timestamp := header.Get("X-Slack-Request-Timestamp")
+		if err := h.checkTimestamp(timestamp, now); err != nil {
+			return err
+		}
+		signature, _ := strings.CutPrefix(header.Get("X-Slack-Signature"), "v0=")
+		return checkSignature(secret, signature, append([]byte("v0:"+timestamp+":"), body...))
+	case webhookHMAC:
+		signature, _ := strings.CutPrefix(header.Get(h.header), "sha256=")
+		if h.timestampHeader == "" {
+			return checkSignature(secret, signature, body)
+		}
+		timestamp := header.Get(h.timestampHeader)
+		if err := h.checkTimestamp(timestamp, now); err != nil {
+			return err
+		}
+		return checkSignature(secret, signature, append([]byte(timestamp+"."), body...))
+	}
+	return errWebhookSignature
+}
+
+// checkTimestamp returns an error unless timestamp (in Unix seconds)
+// is within the webhook's maxAge of now.
+func (h *webhook) checkTimestamp(timestamp string, now time.Time) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errWebhookSignature
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > h.maxAge || age < -h.maxAge {
+		return errWebhookExpired
+	}
+	return nil
+}
+
+// checkSignature returns an error unless signature is the hex-encoded
+// HMAC-SHA256 of message with secret.
+func checkSignature(secret []byte, signature string, message []byte) error {
+	decoded, err := hex.DecodeString(signature)
+	if err != nil {
+		return errWebhookSignature
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(message)
+	if !hmac.Equal(decoded, mac.Sum(nil)) {
+		return errWebhookSignature
+	}
+	return nil
+}
+
+// loadWebhookSecrets reads the secrets of the service's -webhooks, if
+// they aren't loaded yet.
+func (s *ValidTailnetSrv) loadWebhookSecrets() error {
+	if len(s.webhookSecrets) == len(s.Webhooks) {
+		return nil
+	}
+	secrets := make([][]byte, 0, len(s.Webhooks))
+	for _, h := range s.Webhooks {
+		secret, err := os.ReadFile(h.secretFile)
+		if err != nil {
+			return fmt.Errorf("reading secret of webhook %v: %w", h.path, err)
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) == 0 {
+			// Anyone could sign requests with an empty secret:
+			return fmt.Errorf("%w: %v", errWebhookSecretEmpty, h.secretFile)
+		}
+		secrets = append(secrets, secret)
+	}
+	s.webhookSecrets = secrets
+	return nil
+}
+
+// webhookFor returns the index of the first -webhook that covers
+// requests for path, or -1 if there is none.
+func (s *TailnetSrv) webhookFor(path string) int {
+	for i := range s.Webhooks {
+		if s.Webhooks[i].appliesTo(path) {
+			return i
+		}
+	}
+	return -1
+}
+
+// verifyWebhooks answers requests under a -webhook path whose
+// signature doesn't check out with a 401 status, before they reach
+// the upstream service.
+func (s *ValidTailnetSrv) verifyWebhooks(next http.Handler) http.Handler {
+	if len(s.Webhooks) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := s.webhookFor(r.URL.Path)
+		if i < 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := &s.Webhooks[i]
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBody))
+		if err != nil {
+			if tooLarge(err) {
+				http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "400 Bad Request: could not read body", http.StatusBadRequest)
+			return
+		}
+		labels := prometheus.Labels{"service": s.Name, "path": h.path, "result": "valid"}
+		if err := h.verify(s.webhookSecrets[i], r.Header, body, time.Now()); err != nil {
+			labels["result"] = "invalid"
+			if errors.Is(err, errWebhookExpired) {
+				labels["result"] = "expired"
+			}
+			webhookVerifications.With(labels).Inc()
+			s.log().Warn("Rejected webhook request",
+				"url", r.URL,
+				"webhook", h,
+				"error", err,
+			)
+			http.Error(w, "401 Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		webhookVerifications.With(labels).Inc()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next.ServeHTTP(w, r)
+	})
+}
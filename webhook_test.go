@@ -0,0 +1,143 @@
+package tsnsrv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookFormat(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		value      string
+		serialized string
+	}{
+		{"/github=github:/run/secrets/gh", "/github=github:/run/secrets/gh"},
+		{"/stripe=stripe:secret,maxAge=1m", "/stripe=stripe:secret,maxAge=1m0s"},
+		{"/hook=hmac:secret", "/hook=hmac:secret,header=X-Signature"},
+		{"/hook=hmac:secret,header=x-hook-sig,timestampHeader=x-hook-time", "/hook=hmac:secret,header=X-Hook-Sig,timestampHeader=X-Hook-Time"},
+
+		// Expected to fail:
+		{"github:secret", ""},
+		{"/github=github", ""},
+		{"/github=bitbucket:secret", ""},
+		{"/github=github:secret,header=X-Sig", ""},
+		{"/stripe=stripe:secret,maxAge=forever", ""},
+	} {
+		test := elt
+		t.Run(test.value, func(t *testing.T) {
+			t.Parallel()
+			var hooks webhooks
+			err := hooks.Set(test.value)
+			if test.serialized != "" {
+				require.NoError(t, err)
+				assert.Equal(t, test.serialized, hooks.String())
+			} else {
+				require.ErrorIs(t, err, errWebhookFormat)
+			}
+		})
+	}
+}
+
+func TestWebhookEmptySecret(t *testing.T) {
+	t.Parallel()
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte(" \n"), 0o600))
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(), "-webhook", "/gitlab=gitlab:" + secretFile, "http://example.com"})
+	require.NoError(t, err)
+	require.ErrorIs(t, s.loadWebhookSecrets(), errWebhookSecretEmpty)
+}
+
+// hexHMAC returns the hex-encoded HMAC-SHA256 of message with secret.
+func hexHMAC(secret, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhooks(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret"), []byte("s3cret\n"), 0o600))
+	secretFile := filepath.Join(dir, "secret")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.URL.Path, body)
+	}))
+	t.Cleanup(upstream.Close)
+
+	s, _, err := TailnetSrvFromArgs([]string{"tsnsrv", "-name", t.Name(),
+		"-webhook", "/github=github:" + secretFile,
+		"-webhook", "/gitlab=gitlab:" + secretFile,
+		"-webhook", "/stripe=stripe:" + secretFile,
+		"-webhook", "/slack=slack:" + secretFile + ",maxAge=1m",
+		"-webhook", "/hmac=hmac:" + secretFile + ",header=X-Sig",
+		"-webhook", "/timed=hmac:" + secretFile + ",header=X-Sig,timestampHeader=X-Time",
+		upstream.URL,
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.loadWebhookSecrets())
+	proxy := httptest.NewServer(s.mux(http.DefaultTransport, true))
+	t.Cleanup(proxy.Close)
+
+	const body = `{"event":"push"}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	for _, elt := range []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"unsigned path", "/other", nil, http.StatusOK},
+		{"path next to a webhook", "/github-mirror", nil, http.StatusOK},
+		{"github", "/github/push", map[string]string{"X-Hub-Signature-256": "sha256=" + hexHMAC("s3cret", body)}, http.StatusOK},
+		{"github unsigned", "/github/push", nil, http.StatusUnauthorized},
+		{"github wrong secret", "/github/push", map[string]string{"X-Hub-Signature-256": "sha256=" + hexHMAC("guess", body)}, http.StatusUnauthorized},
+		{"gitlab", "/gitlab", map[string]string{"X-Gitlab-Token": "s3cret"}, http.StatusOK},
+		{"gitlab wrong token", "/gitlab", map[string]string{"X-Gitlab-Token": "guess"}, http.StatusUnauthorized},
+		{"stripe", "/stripe", map[string]string{"Stripe-Signature": "t=" + now + ",v1=" + hexHMAC("old", now+"."+body) + ",v1=" + hexHMAC("s3cret", now+"."+body)}, http.StatusOK},
+		{"stripe replayed", "/stripe", map[string]string{"Stripe-Signature": "t=" + old + ",v1=" + hexHMAC("s3cret", old+"."+body)}, http.StatusUnauthorized},
+		{"stripe other timestamp", "/stripe", map[string]string{"Stripe-Signature": "t=" + now + ",v1=" + hexHMAC("s3cret", old+"."+body)}, http.StatusUnauthorized},
+		{"slack", "/slack", map[string]string{"X-Slack-Request-Timestamp": now, "X-Slack-Signature": "v0=" + hexHMAC("s3cret", "v0:"+now+":"+body)}, http.StatusOK},
+		{"slack replayed", "/slack", map[string]string{"X-Slack-Request-Timestamp": old, "X-Slack-Signature": "v0=" + hexHMAC("s3cret", "v0:"+old+":"+body)}, http.StatusUnauthorized},
+		{"hmac", "/hmac", map[string]string{"X-Sig": hexHMAC("s3cret", body)}, http.StatusOK},
+		{"hmac with prefix", "/hmac", map[string]string{"X-Sig": "sha256=" + hexHMAC("s3cret", body)}, http.StatusOK},
+		{"hmac in default header", "/hmac", map[string]string{"X-Signature": hexHMAC("s3cret", body)}, http.StatusUnauthorized},
+		{"timed hmac", "/timed", map[string]string{"X-Time": now, "X-Sig": hexHMAC("s3cret", now+"."+body)}, http.StatusOK},
+		{"timed hmac replayed", "/timed", map[string]string{"X-Time": old, "X-Sig": hexHMAC("s3cret", old+"."+body)}, http.StatusUnauthorized},
+		{"timed hmac without timestamp", "/timed", map[string]string{"X-Sig": hexHMAC("s3cret", body)}, http.StatusUnauthorized},
+	} {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, proxy.URL+test.path, strings.NewReader(body))
+			require.NoError(t, err)
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := proxy.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, test.status, resp.StatusCode, string(got))
+			if test.status == http.StatusOK {
+				assert.Equal(t, test.path+" "+body, string(got), "the upstream gets the whole body")
+			}
+		})
+	}
+}